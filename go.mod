@@ -3,13 +3,12 @@ module github.com/diamondburned/html2text
 go 1.18
 
 require (
+	github.com/mattn/go-runewidth v0.0.14
 	github.com/olekukonko/tablewriter v0.0.5
 	github.com/ssor/bom v0.0.0-20170718123548-6386211fdfcf
 	golang.org/x/net v0.2.0
+	golang.org/x/text v0.4.0
 	jaytaylor.com/html2text v0.0.0-20211105163654-bc68cce691ba
 )
 
-require (
-	github.com/mattn/go-runewidth v0.0.14 // indirect
-	github.com/rivo/uniseg v0.2.0 // indirect
-)
+require github.com/rivo/uniseg v0.2.0 // indirect
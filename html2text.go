@@ -1,27 +1,118 @@
 package html2text
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/mattn/go-runewidth"
 	"github.com/olekukonko/tablewriter"
 	"github.com/ssor/bom"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/unicode/norm"
 )
 
 // Options provide toggles and overrides to control specific rendering behaviors.
 type Options struct {
-	PrettyTables        bool                 // Turns on pretty ASCII rendering for table elements.
-	PrettyTablesOptions *PrettyTablesOptions // Configures pretty ASCII rendering for table elements.
-	OmitLinks           bool                 // Turns on omitting links
-	TextOnly            bool                 // Returns only plain text
+	PrettyTables            bool                                 // Turns on pretty ASCII rendering for table elements.
+	PrettyTablesOptions     *PrettyTablesOptions                 // Configures pretty ASCII rendering for table elements.
+	OmitLinks               bool                                 // Turns on omitting links
+	LinkPlacement           LinkPlacement                        // Places link hrefs relative to the link text
+	TextOnly                bool                                 // Returns only plain text
+	KeepComments            bool                                 // Turns on emitting HTML comments
+	HeadingBottomSpacing    int                                  // Number of newlines after a heading
+	BlockquoteAttribution   bool                                 // Renders blockquote attributions after the quote
+	EmitTitle               bool                                 // Renders the document title as a heading
+	HeadingNumbering        bool                                 // Prefixes headings with hierarchical numbers
+	HeadingAnchors          bool                                 // Appends anchors to headings
+	HeadingAnchorFormat     string                               // Formats heading anchors
+	OmitH1TopDivider        bool                                 // Omits the divider line above H1 headings
+	BidiControls            bool                                 // Wraps bdi and bdo content in Unicode bidi control characters
+	MaxDepth                int                                  // Maximum node nesting depth
+	MaxLength               int                                  // Maximum output length in runes
+	TableSeparator          string                               // Separates back-to-back tables
+	NumberParagraphs        bool                                 // Prefixes paragraphs with their numbers
+	NumberTables            bool                                 // Labels tables with their numbers
+	StrictTables            bool                                 // Rejects tables with mismatched column counts
+	KeepNBSP                bool                                 // Keeps non-breaking spaces
+	RenderGauges            bool                                 // Renders progress and meter elements as bars
+	GaugeWidth              int                                  // Width of gauge bars
+	MaxLinkTextLength       int                                  // Maximum link text length in runes
+	LinkDedupWindow         int                                  // Number of preceding links checked for repeated hrefs
+	WrapURLs                bool                                 // Allows wrapping long link hrefs
+	StripTrackingParams     bool                                 // Removes tracking query parameters from link hrefs
+	TrackingParams          []string                             // Query parameters removed by StripTrackingParams
+	URLNormalizer           func(string) string                  // Rewrites link hrefs before they are emitted
+	HTMLEntitiesInOutput    bool                                 // Escapes <, > and & in the output as HTML entities
+	MergeAdjacentEmphasis   bool                                 // Merges adjacent emphasis of the same kind
+	KeepNestedEmphasis      bool                                 // Repeats markers for nested emphasis of the same kind
+	BoldDelimiter           string                               // Surrounds bold text
+	EmphasisDelimiter       string                               // Surrounds italic text
+	Writer                  io.Writer                            // Also receives the output if set
+	PlainTableColumnPadding *PlainTableColumnPadding             // Aligns table cells into columns without PrettyTables
+	Trace                   func(node *html.Node, action string) // Called as nodes are traversed, for debugging
+	TextTransformer         func(string) string                  // Rewrites the content of text nodes
+	LinkSchemeWhitelist     []string                             // Allowed link href schemes if set
+	IncludeImageURLs        bool                                 // Renders images with their source URLs
+	KeepDataURIImages       bool                                 // Keeps data: URIs in image sources and link hrefs
+	PreserveEmptyParagraphs bool                                 // Keeps a blank line for each empty p element
+	Charset                 string                               // Decodes the input from the named charset
+	DetectCharset           bool                                 // Decodes the input from its declared charset
+	NormalizeUnicode        string                               // Unicode normalization form of the output
+	Indent                  int                                  // Indents every line by this many spaces
+	TrailingNewline         bool                                 // Ends non-empty output with a newline
+	TablesAsCSV             bool                                 // Renders tables as CSV records
+	CSVSeparator            rune                                 // Separates the fields of TablesAsCSV records
+	TablesAsKeyValue        bool                                 // Renders two-column tables as key-value lines
+	ImagePlaceholder        string                               // Formats image alt text
+	UppercaseHeadings       bool                                 // Uppercases the text of headings
+	SentencePerLine         bool                                 // Breaks lines after each sentence
+	ShowLang                bool                                 // Annotates content in other languages
+	SkipNoscript            bool                                 // Skips the fallback content of noscript elements
+	SkipAriaHidden          bool                                 // Skips aria-hidden elements
+	ParenthesizeSmall       bool                                 // Renders small elements in parentheses
+	SmallDelimiters         [2]string                            // Surround small elements with ParenthesizeSmall
+	RenderFormControls      bool                                 // Renders buttons and inputs
+	PreTrimIndent           bool                                 // Removes the common indentation of pre elements
+	InlineRuby              bool                                 // Renders ruby annotations right after their base text
+	DataValues              bool                                 // Appends the values of data elements
+	TimeFormatter           func(datetime string) string         // Formats the datetime of time elements
+	AppendFormattedTime     bool                                 // Appends formatted times instead of replacing the text
+	ReferenceLinks          bool                                 // Renders links as reference-style links
+	ANSIColors              bool                                 // Renders formatting with ANSI escape sequences
+	CodeFences              bool                                 // Renders code in Markdown code fences
+	LineEnding              string                               // Ends lines with this instead of "\n"
 }
 
+// Actions passed to Options.Trace.
+const (
+	TraceEnter = "enter" // An element is about to be rendered.
+	TraceSkip  = "skip"  // An element or comment is dropped along with its subtree.
+	TraceEmit  = "emit"  // The content of a text or comment node is emitted.
+)
+
+// LinkPlacement is where link hrefs are placed relative to the link text.
+type LinkPlacement int
+
+const (
+	LinkAfterText      LinkPlacement = iota // "text (href)", the default
+	LinkBeforeText                          // "(href) text"
+	LinkOnSeparateLine                      // "text" followed by "(href)" on a line of its own
+)
+
 // PrettyTablesOptions overrides tablewriter behaviors
 type PrettyTablesOptions struct {
 	AutoFormatHeader     bool
@@ -42,6 +133,14 @@ type PrettyTablesOptions struct {
 	Borders              tablewriter.Border
 }
 
+// PlainTableColumnPadding configures the alignment of table cells into columns
+// when tables are rendered without PrettyTables.
+type PlainTableColumnPadding struct {
+	MinWidth  int    // Minimum width of each column
+	Padding   rune   // Pads cells to the width of their column, defaults to a space
+	Separator string // Separates columns, defaults to two spaces
+}
+
 // NewPrettyTablesOptions creates PrettyTablesOptions with default settings
 func NewPrettyTablesOptions() *PrettyTablesOptions {
 	return &PrettyTablesOptions{
@@ -64,46 +163,296 @@ func NewPrettyTablesOptions() *PrettyTablesOptions {
 	}
 }
 
+// ErrInvalidOptions is returned when Options are out of range or contradict
+// each other.
+var ErrInvalidOptions = errors.New("html2text: invalid options")
+
+// Validate returns an error wrapping ErrInvalidOptions if the options are out
+// of range or contradict each other.
+func (o Options) Validate() error {
+	for _, opt := range []struct {
+		name  string
+		value int
+	}{
+		{"HeadingBottomSpacing", o.HeadingBottomSpacing},
+		{"MaxDepth", o.MaxDepth},
+		{"MaxLength", o.MaxLength},
+		{"GaugeWidth", o.GaugeWidth},
+		{"LinkDedupWindow", o.LinkDedupWindow},
+		{"Indent", o.Indent},
+		{"MaxLinkTextLength", o.MaxLinkTextLength},
+	} {
+		if opt.value < 0 {
+			return fmt.Errorf("%w: %s is negative", ErrInvalidOptions, opt.name)
+		}
+	}
+
+	if o.Indent >= lineWidth {
+		return fmt.Errorf("%w: Indent leaves no room for text within %d columns", ErrInvalidOptions, lineWidth)
+	}
+
+	if o.LinkPlacement < LinkAfterText || o.LinkPlacement > LinkOnSeparateLine {
+		return fmt.Errorf("%w: unknown LinkPlacement %d", ErrInvalidOptions, o.LinkPlacement)
+	}
+
+	if o.PlainTableColumnPadding != nil && o.PlainTableColumnPadding.MinWidth < 0 {
+		return fmt.Errorf("%w: PlainTableColumnPadding.MinWidth is negative", ErrInvalidOptions)
+	}
+
+	if o.Charset != "" {
+		if enc, _ := charset.Lookup(o.Charset); enc == nil {
+			return fmt.Errorf("%w: unknown Charset %q", ErrInvalidOptions, o.Charset)
+		}
+	}
+
+	if _, ok := unicodeForms[o.NormalizeUnicode]; !ok && o.NormalizeUnicode != "" {
+		return fmt.Errorf("%w: unknown NormalizeUnicode form %q", ErrInvalidOptions, o.NormalizeUnicode)
+	}
+
+	if o.TablesAsCSV {
+		if o.PrettyTables {
+			return fmt.Errorf("%w: PrettyTables and TablesAsCSV are both set", ErrInvalidOptions)
+		}
+		if o.TablesAsKeyValue {
+			return fmt.Errorf("%w: TablesAsKeyValue and TablesAsCSV are both set", ErrInvalidOptions)
+		}
+	}
+	switch r := o.CSVSeparator; {
+	case r == '"', r == '\r', r == '\n', r == utf8.RuneError, !utf8.ValidRune(r):
+		return fmt.Errorf("%w: CSVSeparator %q can't separate fields", ErrInvalidOptions, r)
+	}
+	return nil
+}
+
 // FromHTMLNode renders text output from a pre-parsed HTML document.
+// ErrCyclicTree is returned if the document is not a well-formed tree.
 func FromHTMLNode(doc *html.Node, o ...Options) (string, error) {
-	var options Options
-	if len(o) > 0 {
-		options = o[0]
+	options := firstOptions(o)
+	if err := options.Validate(); err != nil {
+		return "", err
 	}
-
-	ctx := textifyTraverseContext{
-		options: options,
+	if err := checkNodeTree(doc); err != nil {
+		return "", err
 	}
-	ctx.lineWrapper = lineWrapper{
-		out:   &ctx.buf,
-		width: 78,
+	return renderDocument(doc, options, nil)
+}
+
+func firstOptions(o []Options) Options {
+	if len(o) > 0 {
+		return o[0]
 	}
+	return Options{}
+}
 
+// renderDocument renders text output from a document known to be a tree.
+func renderDocument(doc *html.Node, options Options, warnings *[]Warning) (string, error) {
+	ctx := newTextifyTraverseContext(options, 0)
+	ctx.warnings = warnings
+	ctx.linkCtx.root = doc
 	if err := ctx.traverse(doc); err != nil {
 		return "", err
 	}
+	return ctx.finish()
+}
+
+// finish returns the text rendered by ctx once it has traversed the whole
+// document, after applying the options that transform the complete text. Text
+// longer than MaxLength runes is cut down by truncatedText.
+func (ctx *textifyTraverseContext) finish() (string, error) {
+	options := ctx.options
+
+	text := ctx.finalText(ctx.text(), true)
+	if options.MaxLength > 0 && utf8.RuneCountInString(text) > options.MaxLength {
+		text = ctx.truncatedText(options.MaxLength)
+	}
+
+	if options.Writer != nil {
+		if _, err := io.WriteString(options.Writer, text); err != nil {
+			return "", err
+		}
+	}
 
-	text := strings.TrimSpace(newlineRe.ReplaceAllString(
-		strings.Replace(ctx.buf.String(), "\n ", "\n", -1), "\n\n"),
-	)
 	return text, nil
 }
 
+// finalText applies the options that transform the complete text to text,
+// appending the list of reference links if references is set.
+func (ctx *textifyTraverseContext) finalText(text string, references bool) string {
+	options := ctx.options
+
+	if references && len(ctx.linkCtx.references) > 0 {
+		text = appendReferences(text, ctx.linkCtx.references)
+	}
+
+	if form, ok := unicodeForms[options.NormalizeUnicode]; ok {
+		text = form.String(text)
+	}
+
+	if options.HTMLEntitiesInOutput {
+		// The parser has already decoded all entities in the input, so this
+		// never double-encodes them.
+		text = htmlEscaper.Replace(text)
+	}
+
+	if options.Indent > 0 {
+		text = indentLines(text, strings.Repeat(" ", options.Indent))
+	}
+
+	if options.TrailingNewline && text != "" {
+		text += "\n"
+	}
+
+	if options.LineEnding != "" && options.LineEnding != "\n" {
+		// Lines are assembled with "\n" throughout, including by the table
+		// renderers, so they are only converted once the text is complete.
+		text = strings.ReplaceAll(text, "\n", options.LineEnding)
+	}
+
+	return text
+}
+
+// unicodeForms maps the names accepted by Options.NormalizeUnicode to their
+// normalization forms.
+var unicodeForms = map[string]norm.Form{
+	"NFC":  norm.NFC,
+	"NFKC": norm.NFKC,
+}
+
+// appendReferences appends the link reference definitions for
+// Options.ReferenceLinks to text, separated from it by a blank line.
+func appendReferences(text string, references []string) string {
+	var buf strings.Builder
+	buf.WriteString(text)
+	for i, href := range references {
+		if buf.Len() > 0 {
+			if i == 0 {
+				buf.WriteString("\n\n")
+			} else {
+				buf.WriteString("\n")
+			}
+		}
+		if strings.ContainsAny(href, " <>") {
+			// Link destinations containing spaces must be enclosed in angle
+			// brackets.
+			href = "<" + strings.NewReplacer("<", "%3C", ">", "%3E").Replace(href) + ">"
+		}
+		fmt.Fprintf(&buf, "[%d]: %s", i+1, href)
+	}
+	return buf.String()
+}
+
+// indentLines prefixes each line of text that isn't blank with indent.
+func indentLines(text, indent string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderNode renders text output from node as a separate fragment of the
+// document, continuing the traversal depth, warnings, links, headings and
+// counters of ctx. Document-wide options such as MaxLength are not applied.
+func (ctx *textifyTraverseContext) renderNode(node *html.Node) (string, error) {
+	nodeCtx := newTextifyTraverseContext(ctx.options, ctx.depth)
+	nodeCtx.warnings = ctx.warnings
+	nodeCtx.linkCtx = ctx.linkCtx
+	nodeCtx.headingCtx = ctx.headingCtx
+	nodeCtx.tableCount = ctx.tableCount
+	nodeCtx.paragraphCount = ctx.paragraphCount
+	if err := nodeCtx.traverse(node); err != nil {
+		return "", err
+	}
+	return nodeCtx.text(), nil
+}
+
 // FromReader renders text output after parsing HTML for the specified
 // io.Reader.
 func FromReader(reader io.Reader, options ...Options) (string, error) {
+	return fromReader(reader, firstOptions(options), nil)
+}
+
+// FromReaderWithWarnings is like FromReader, but also returns warnings about
+// content that was dropped or couldn't be rendered faithfully.
+func FromReaderWithWarnings(reader io.Reader, options ...Options) (string, []Warning, error) {
+	var warnings []Warning
+	text, err := fromReader(reader, firstOptions(options), &warnings)
+	if err != nil {
+		return "", warnings, err
+	}
+	return text, warnings, nil
+}
+
+func fromReader(reader io.Reader, options Options, warnings *[]Warning) (string, error) {
+	if err := options.Validate(); err != nil {
+		return "", err
+	}
 	newReader, err := bom.NewReaderWithoutBom(reader)
 	if err != nil {
 		return "", err
 	}
+	if newReader, err = decodeCharset(newReader, options); err != nil {
+		return "", err
+	}
 	doc, err := html.Parse(newReader)
 	if err != nil {
 		return "", err
 	}
-	return FromHTMLNode(doc, options...)
+	// Parsed documents are always well-formed trees.
+	return renderDocument(doc, options, warnings)
+}
+
+// decodeCharset returns a reader decoding r to UTF-8 from the charset given by
+// Options.Charset or, if Options.DetectCharset is set, by the document itself.
+// Otherwise, r is assumed to be UTF-8 already.
+func decodeCharset(r io.Reader, options Options) (io.Reader, error) {
+	if options.Charset != "" {
+		return charset.NewReaderLabel(options.Charset, r)
+	}
+	if !options.DetectCharset {
+		return r, nil
+	}
+
+	// Without a declared charset, DetermineEncoding guesses windows-1252 for
+	// text without any non-ASCII characters. Ending the preview in one, which
+	// is followed by a space so that it isn't cut off as a partial rune, makes
+	// it keep assuming UTF-8 instead, unless the preview isn't valid UTF-8.
+	const utf8Hint = "\u00E9 "
+
+	br := bufio.NewReaderSize(r, charsetPreviewSize)
+	preview, err := br.Peek(charsetPreviewSize - len(utf8Hint))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Drop a rune cut off by the end of the preview, which isn't valid.
+	for i := len(preview) - 1; i >= 0 && i > len(preview)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(preview[i]) {
+			if !utf8.FullRune(preview[i:]) {
+				preview = preview[:i]
+			}
+			break
+		}
+	}
+	preview = append(preview[:len(preview):len(preview)], utf8Hint...)
+
+	enc, _, _ := charset.DetermineEncoding(preview, "")
+	return enc.NewDecoder().Reader(br), nil
 }
 
+// charsetPreviewSize is the number of bytes looked at for a charset declared
+// in a meta element, as in charset.DetermineEncoding.
+const charsetPreviewSize = 1024
+
 // FromString parses HTML from the input string, then renders the text form.
+//
+// Converting the output of a single paragraph again leaves it unchanged, as its
+// lines are joined and then wrapped at the same points. This doesn't hold for
+// several paragraphs, since line breaks are only whitespace in HTML and the
+// blank lines between them are lost, nor for text with "&" or "<" unless
+// HTMLEntitiesInOutput is set.
 func FromString(input string, options ...Options) (string, error) {
 	bs := bom.CleanBom([]byte(input))
 	text, err := FromReader(bytes.NewReader(bs), options...)
@@ -113,409 +462,3664 @@ func FromString(input string, options ...Options) (string, error) {
 	return text, nil
 }
 
-var (
-	newlineRe = regexp.MustCompile(`\n\n+`)
-)
+// FromStringWithWarnings is like FromString, but also returns warnings about
+// content that was dropped or couldn't be rendered faithfully.
+func FromStringWithWarnings(input string, options ...Options) (string, []Warning, error) {
+	bs := bom.CleanBom([]byte(input))
+	return FromReaderWithWarnings(bytes.NewReader(bs), options...)
+}
 
-// traverseTableCtx holds text-related context.
-type textifyTraverseContext struct {
-	buf strings.Builder
+// FromTokenizer renders text output from the tokens of z as they are read,
+// without parsing the whole document into a tree first, which keeps memory use
+// low for very large documents.
+//
+// Only the structure of headings, paragraphs, lists, preformatted text, line
+// breaks, emphasis, links, images and form inputs is rendered as FromReader
+// renders it. Other elements only have their text rendered, elements skipped by
+// FromReader aside.
+//
+// In particular, elements that need to look ahead at their content aren't
+// rendered as they are by FromReader: this includes tables, whose cells are
+// separated by spaces, details and select elements, ruby annotations, the alt
+// text of images within links and the checkboxes of task list items, which
+// aren't rendered in their markers. The href of a link wrapping block content
+// follows its last block on a line of its own. Reversed ordered lists count up.
+// Emphasis around blocks, whether from an element or declared in a style,
+// spans them rather than surrounding the text of each, and line breaks within
+// emphasis are kept.
+//
+// Code, kbd, small, dfn, data, bdi, bdo, button, progress and meter elements
+// render their text alone, so CodeFences, ParenthesizeSmall, DataValues,
+// BidiControls and RenderGauges have no effect on them. Options that rely on
+// the content of an element or on the elements around it have no effect
+// either: these are PrettyTables, TablesAsCSV, TablesAsKeyValue, StrictTables,
+// NumberTables, TableSeparator, NumberParagraphs, PreserveEmptyParagraphs,
+// MergeAdjacentEmphasis, MaxLinkTextLength, BlockquoteAttribution, EmitTitle,
+// PreTrimIndent, SkipAriaHidden and TimeFormatter.
+//
+// As the tokenizer doesn't correct malformed markup like the parser does,
+// elements that are closed out of order may also render differently.
+func FromTokenizer(z *html.Tokenizer, options ...Options) (string, error) {
+	o := firstOptions(options)
+	if err := o.Validate(); err != nil {
+		return "", err
+	}
 
-	prefix          string
-	tableCtx        tableTraverseContext
-	options         Options
-	endsWithSpace   bool
-	justClosedDiv   bool
-	blockquoteLevel int
-	tableLevel      int
-	lineWrapper     lineWrapper
-	isPre           bool
+	stream := newTokenStream(o)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if err := z.Err(); err != io.EOF {
+				return "", err
+			}
+			break
+		}
+		if err := stream.token(tt, z.Token()); err != nil {
+			return "", err
+		}
+	}
+	if err := stream.closeFrom(0); err != nil {
+		return "", err
+	}
+	return stream.root.finish()
 }
 
-// tableTraverseContext holds table ASCII-form related context.
-type tableTraverseContext struct {
-	header     []string
-	body       [][]string
-	footer     []string
-	tmpRow     int
-	isInFooter bool
-}
+// tokenStream renders the tokens read by FromTokenizer.
+type tokenStream struct {
+	root *textifyTraverseContext
+	ctx  *textifyTraverseContext // receives the output, a sub-context of root within headings
+	open []*streamElement        // elements not yet closed, innermost last
+	skip int                     // number of open elements whose content is ignored
 
-func (tableCtx *tableTraverseContext) init() {
-	tableCtx.body = [][]string{}
-	tableCtx.header = []string{}
-	tableCtx.footer = []string{}
-	tableCtx.isInFooter = false
-	tableCtx.tmpRow = 0
-}
+	trimNewline bool // a newline starting the next text is dropped, as after <pre>
 
-func (ctx *textifyTraverseContext) sub() *textifyTraverseContext {
-	subCtx := textifyTraverseContext{}
-	subCtx.options = ctx.options
-	subCtx.lineWrapper = lineWrapper{
-		out:   &subCtx.buf,
-		width: ctx.lineWrapper.width,
-	}
-	return &subCtx
+	pendingOpen  string // markers of emphasis opened before any of its text
+	pendingSpace string // whitespace ending the last text within emphasis, moved after its markers
 }
 
-func (ctx *textifyTraverseContext) handleElement(node *html.Node) error {
-	ctx.justClosedDiv = false
+// streamElement is an element opened by a start tag in a tokenStream.
+type streamElement struct {
+	node   *html.Node
+	skip   bool                    // the content of the element is ignored
+	inert  bool                    // the element was opened within ignored content
+	parent *textifyTraverseContext // context to restore once a heading closes
+	indent int                     // line wrapper indent to restore once a list item closes
+	number int                     // number of the next item of an ordered list
+	href   string                  // href of a link
+	kind   emphasis                // emphasis opened by the element
+	close  string                  // markers to close the emphasis with
+	pre    bool                    // the style of the element preserves whitespace
+	first  bool                    // the element is the first content of its parent
+	filled bool                    // the element has content, an element or text other than whitespace
+	held   bool                    // the break ending a paragraph that started the list item is held back
+	text   strings.Builder         // text content of headings and links
+	lang   string                  // language declared by the element or inherited
+	marked bool                    // the element added a ShowLang marker
+}
 
-	switch node.DataAtom {
-	case atom.Br:
-		return ctx.emit("\n\n")
+func newTokenStream(options Options) *tokenStream {
+	ctx := newTextifyTraverseContext(options, 0)
+	return &tokenStream{root: ctx, ctx: ctx}
+}
 
-	case atom.H1, atom.H2, atom.H3:
-		subCtx := ctx.sub()
-		if err := subCtx.traverseChildren(node); err != nil {
-			return err
+func (stream *tokenStream) token(tt html.TokenType, tok html.Token) error {
+	switch tt {
+	case html.TextToken:
+		if stream.skip > 0 {
+			return nil
 		}
-
-		str := subCtx.buf.String()
-		if ctx.options.TextOnly {
-			return ctx.emit(str + "\n\n")
+		data := tok.Data
+		if stream.trimNewline {
+			data = strings.TrimPrefix(data, "\n")
+			stream.trimNewline = false
 		}
-
-		dividerLen := 0
-		for _, line := range strings.Split(str, "\n") {
-			line = strings.TrimRightFunc(line, unicode.IsSpace)
-			if lineLen := runewidth.StringWidth(line); lineLen > dividerLen {
-				dividerLen = lineLen
+		if n := len(stream.open); n > 0 && stream.open[n-1].node.DataAtom == atom.Noscript {
+			// The tokenizer leaves the fallback content as unparsed markup.
+			return stream.ctx.renderMarkup(data, nil)
+		}
+		for _, e := range stream.open {
+			if e.node.DataAtom == atom.A || e.node.DataAtom == atom.H1 || e.node.DataAtom == atom.H2 ||
+				e.node.DataAtom == atom.H3 || e.node.DataAtom == atom.Legend {
+				e.text.WriteString(data)
+			}
+		}
+		if strings.TrimSpace(data) != "" && len(stream.open) > 0 {
+			if err := stream.content(); err != nil {
+				return err
 			}
 		}
+		if stream.ctx.emphasis != 0 || stream.pendingOpen != "" {
+			return stream.emphasisText(data)
+		}
+		return stream.ctx.traverse(&html.Node{Type: html.TextNode, Data: data})
 
-		var divider string
-		if node.DataAtom == atom.H1 {
-			divider = strings.Repeat("*", dividerLen)
-		} else {
-			divider = strings.Repeat("-", dividerLen)
+	case html.CommentToken:
+		if stream.skip > 0 {
+			return nil
 		}
+		return stream.ctx.traverse(&html.Node{Type: html.CommentNode, Data: tok.Data})
 
-		ctx.emit("\n\n")
+	case html.StartTagToken, html.SelfClosingTagToken:
+		return stream.start(tok, tt == html.SelfClosingTagToken)
 
-		if node.DataAtom == atom.H1 {
-			ctx.emit(divider)
-			ctx.emit("\n")
+	case html.EndTagToken:
+		for i := len(stream.open) - 1; i >= 0; i-- {
+			if node := stream.open[i].node; node.DataAtom == tok.DataAtom && node.Data == tok.Data {
+				return stream.closeFrom(i)
+			}
 		}
+	}
+	return nil
+}
 
-		ctx.emit(str)
-		ctx.emit("\n")
+// start opens the element of a start tag, closing the elements it implicitly
+// ends first.
+func (stream *tokenStream) start(tok html.Token, selfClosing bool) error {
+	if err := stream.impliedEnd(tok.DataAtom); err != nil {
+		return err
+	}
 
-		ctx.emit(divider)
-		ctx.emit("\n\n")
-		return nil
+	ctx := stream.ctx
+	if ctx.options.MaxDepth > 0 && len(stream.open) >= ctx.options.MaxDepth {
+		return ErrMaxDepth
+	}
 
-	case atom.Blockquote:
-		ctx.blockquoteLevel++
-		if !ctx.options.TextOnly {
-			ctx.prefix = strings.Repeat(">", ctx.blockquoteLevel) + " "
-		}
-		if err := ctx.emit("\n"); err != nil {
+	e := &streamElement{node: &html.Node{Type: html.ElementNode, DataAtom: tok.DataAtom, Data: tok.Data, Attr: tok.Attr}}
+	node := e.node
+	if n := len(stream.open); n > 0 {
+		e.lang = stream.open[n-1].lang
+	}
+	inherited := e.lang
+	if lang := strings.TrimSpace(getAttrVal(node, "lang")); lang != "" {
+		e.lang = lang
+	}
+	if n := len(stream.open); n > 0 && stream.skip == 0 {
+		e.first = !stream.open[n-1].filled
+		if err := stream.content(); err != nil {
 			return err
 		}
-		if ctx.blockquoteLevel == 1 {
-			if err := ctx.emit("\n"); err != nil {
-				return err
-			}
-		}
-		if err := ctx.traverseChildren(node); err != nil {
+	}
+	opened := !selfClosing && !isVoidElement(node.DataAtom)
+	if opened {
+		stream.open = append(stream.open, e)
+	}
+	if stream.skip > 0 {
+		e.inert = true
+		return nil
+	}
+	ctx.trace(node, TraceEnter)
+	if atomIn(node.DataAtom, streamedElements) {
+		// Emphasis markers are held back until the text of the blocks
+		// within them.
+		if err := stream.endText(!atomIn(node.DataAtom, blockElements)); err != nil {
 			return err
 		}
-		ctx.blockquoteLevel--
-		if !ctx.options.TextOnly {
-			ctx.prefix = strings.Repeat(">", ctx.blockquoteLevel)
-		}
-		if ctx.blockquoteLevel > 0 {
-			ctx.prefix += " "
-		}
-		return ctx.emit("\n\n")
+	}
+	if opened && !ctx.isPre && isPreStyle(node) {
+		ctx.isPre = true
+		e.pre = true
+	}
 
-	case atom.Div:
-		ctx.lineWrapper.flush()
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
-		}
-		var err error
-		if !ctx.justClosedDiv {
-			err = ctx.emit("\n")
+	if ctx.options.ShowLang {
+		if marker := langMarker(node, inherited); marker != "" {
+			ctx.pendingLang += marker
+			e.marked = true
 		}
-		ctx.justClosedDiv = true
+	}
+
+	if err := stream.render(e); err != nil {
 		return err
+	}
+	if opened && !e.skip {
+		// Emphasis declared in the style of an element surrounds its
+		// content.
+		stream.emphasis(e, styleEmphasis(node)&^e.kind)
+	}
+	return nil
+}
 
-	case atom.Li:
-		if !ctx.options.TextOnly {
-			if err := ctx.emit("- "); err != nil {
-				return err
-			}
-		}
+// render renders the start of the element e opened by start.
+func (stream *tokenStream) render(e *streamElement) error {
+	ctx := stream.ctx
+	node := e.node
+	switch node.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Template:
+		ctx.trace(node, TraceSkip)
+		e.skip = true
+		stream.skip++
 
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
+	case atom.Noscript:
+		if ctx.options.SkipNoscript {
+			ctx.trace(node, TraceSkip)
+			e.skip = true
+			stream.skip++
 		}
 
-		return ctx.emit("\n")
+	case atom.Br:
+		return ctx.lineBreak()
 
-	case atom.B, atom.Strong:
-		subCtx := ctx.sub()
-		subCtx.endsWithSpace = true
-		if err := subCtx.traverseChildren(node); err != nil {
-			return err
-		}
-		str := subCtx.buf.String()
-		if ctx.options.TextOnly {
-			return ctx.emit(str)
-		}
-		return ctx.emit("*" + str + "*")
+	case atom.Img:
+		return ctx.imageHandler(node)
 
-	case atom.A:
-		linkText := ""
-		// For simple link element content with single text node only, peek at the link text.
-		if node.FirstChild != nil && node.FirstChild.NextSibling == nil && node.FirstChild.Type == html.TextNode {
-			linkText = node.FirstChild.Data
+	case atom.Input:
+		if ctx.options.RenderFormControls {
+			return ctx.inputHandler(node)
 		}
 
-		// If image is the only child, take its alt text as the link text.
-		if img := node.FirstChild; img != nil && node.LastChild == img && img.DataAtom == atom.Img {
-			if altText := getAttrVal(img, "alt"); altText != "" {
-				if err := ctx.emit(altText); err != nil {
-					return err
-				}
+	case atom.H1, atom.H2, atom.H3, atom.Legend:
+		e.parent = ctx
+		stream.ctx = ctx.headingSub(node)
+
+	case atom.P, atom.Ul, atom.Ol, atom.Blockquote, atom.Table, atom.Fieldset:
+		if node.DataAtom == atom.Ol {
+			e.number = 1
+			if start, err := strconv.Atoi(strings.TrimSpace(getAttrVal(node, "start"))); err == nil {
+				e.number = start
 			}
-		} else if err := ctx.traverseChildren(node); err != nil {
-			return err
 		}
+		return ctx.emit("\n\n")
 
-		hrefLink := ""
-		if attrVal := getAttrVal(node, "href"); attrVal != "" {
-			attrVal = ctx.normalizeHrefLink(attrVal)
-			// Don't print link href if it matches link element content or if the link is empty.
-			if (!ctx.options.OmitLinks && attrVal != "" && linkText != attrVal) || !ctx.options.TextOnly {
-				hrefLink = "(" + attrVal + ")"
-			}
+	case atom.Pre:
+		ctx.isPre = true
+		stream.trimNewline = true
+		return ctx.emit("\n\n")
+
+	case atom.Div:
+		if !ctx.afterListMarker {
+			ctx.lineWrapper.flush()
 		}
 
-		return ctx.emit(hrefLink)
+	case atom.Tr:
+		return ctx.emit("\n")
 
-	case atom.P, atom.Ul:
-		return ctx.paragraphHandler(node)
+	case atom.Td, atom.Th:
+		return ctx.emit(" ")
+
+	case atom.Li:
+		return stream.listItem(e)
+
+	case atom.B, atom.Strong:
+		stream.emphasis(e, emphasisBold)
+
+	case atom.Em, atom.I:
+		stream.emphasis(e, emphasisItalic)
+
+	case atom.A:
+		e.href = ctx.linkHref(node)
+		if e.href != "" && ctx.options.ReferenceLinks && !ctx.options.TextOnly {
+			return ctx.emit("[")
+		}
+		if ctx.options.LinkPlacement == LinkBeforeText {
+			return ctx.emitLinkHref(node, e.href)
+		}
+	}
+	return nil
+}
+
+// listItem starts a list item with its marker.
+func (stream *tokenStream) listItem(e *streamElement) error {
+	ctx := stream.ctx
+	marker := "- "
+	for i := len(stream.open) - 2; i >= 0; i-- {
+		if list := stream.open[i]; list.node.DataAtom == atom.Ol {
+			if value, err := strconv.Atoi(strings.TrimSpace(getAttrVal(e.node, "value"))); err == nil {
+				list.number = value
+			}
+			marker = strconv.Itoa(list.number) + ". "
+			list.number++
+			break
+		} else if list.node.DataAtom == atom.Ul {
+			break
+		}
+	}
+
+	e.indent = ctx.lineWrapper.indent
+	if ctx.options.TextOnly {
+		return nil
+	}
+	if err := ctx.emitListMarker(marker); err != nil {
+		return err
+	}
+	ctx.afterListMarker = true
+	ctx.lineWrapper.indent += stringWidth(marker)
+	return nil
+}
+
+// emphasis starts the kinds of emphasis for the element e, except those it is
+// nested within. The opening markers are held back until the first text within
+// them, so that the whitespace starting it is kept outside of them.
+func (stream *tokenStream) emphasis(e *streamElement, kind emphasis) {
+	ctx := stream.ctx
+	if !ctx.options.KeepNestedEmphasis {
+		kind &^= ctx.emphasis
+	}
+	if ctx.options.TextOnly || kind == 0 {
+		return
+	}
+	for _, k := range []emphasis{emphasisBold, emphasisItalic} {
+		if kind&k != 0 {
+			open, close := ctx.emphasisMarkers(k)
+			stream.pendingOpen += open
+			e.close = close + e.close
+		}
+	}
+	ctx.emphasis |= kind
+	e.kind |= kind
+}
+
+// emphasisText renders text within emphasis. The whitespace surrounding the
+// text is moved outside of the markers of emphasis starting or ending next to
+// it, as FromReader does.
+func (stream *tokenStream) emphasisText(data string) error {
+	ctx := stream.ctx
+	text := data
+	if !ctx.isPre {
+		text = ctx.trimSpace(data)
+	}
+	if text == "" {
+		stream.pendingSpace += data
+		return nil
+	}
+
+	i := strings.Index(data, text)
+	stream.pendingSpace += data[:i]
+	if err := stream.endText(false); err != nil {
+		return err
+	}
+	// The markers are emitted along with the text, as the line wrapper starts
+	// a new line for text following markers of no width, such as ANSI escapes.
+	node := &html.Node{Type: html.TextNode, Data: text}
+	ctx.trace(node, TraceEmit)
+	open := stream.pendingOpen
+	stream.pendingOpen = ""
+	stream.pendingSpace = data[i+len(text):]
+	return ctx.emit(open + ctx.textData(node))
+}
+
+// endText emits the whitespace held back by emphasisText, and the emphasis
+// markers held back by emphasis if markers is set, before the content that
+// follows them.
+func (stream *tokenStream) endText(markers bool) error {
+	ctx := stream.ctx
+	if stream.pendingSpace != "" {
+		space := stream.pendingSpace
+		stream.pendingSpace = ""
+		if err := ctx.traverse(&html.Node{Type: html.TextNode, Data: space}); err != nil {
+			return err
+		}
+	}
+	if !markers || stream.pendingOpen == "" {
+		return nil
+	}
+	open := stream.pendingOpen
+	stream.pendingOpen = ""
+	return ctx.emit(open)
+}
+
+// content records that the innermost open element has content, emitting the
+// break held back after a paragraph that started it.
+func (stream *tokenStream) content() error {
+	parent := stream.open[len(stream.open)-1]
+	parent.filled = true
+	if !parent.held {
+		return nil
+	}
+	parent.held = false
+	return stream.ctx.emit("\n\n")
+}
+
+// impliedEnd closes the elements that a start tag for a ends, such as the
+// previous item of a list.
+func (stream *tokenStream) impliedEnd(a atom.Atom) error {
+	var ends, scope []atom.Atom
+	switch a {
+	case atom.Li:
+		ends, scope = []atom.Atom{atom.Li}, []atom.Atom{atom.Ul, atom.Ol}
+	case atom.Td, atom.Th:
+		ends, scope = []atom.Atom{atom.Td, atom.Th}, []atom.Atom{atom.Tr, atom.Table}
+	case atom.Tr:
+		ends, scope = []atom.Atom{atom.Tr}, []atom.Atom{atom.Table}
+	case atom.P, atom.Div, atom.Ul, atom.Ol, atom.Blockquote, atom.Table, atom.Pre,
+		atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		// Only a paragraph that is the innermost element is ended.
+		if n := len(stream.open); n > 0 && stream.open[n-1].node.DataAtom == atom.P {
+			return stream.closeFrom(n - 1)
+		}
+		return nil
+	default:
+		return nil
+	}
+
+	for i := len(stream.open) - 1; i >= 0; i-- {
+		switch a := stream.open[i].node.DataAtom; {
+		case atomIn(a, ends):
+			return stream.closeFrom(i)
+		case atomIn(a, scope):
+			return nil
+		}
+	}
+	return nil
+}
+
+// closeFrom closes the open elements from the ith on, innermost first.
+func (stream *tokenStream) closeFrom(i int) error {
+	for len(stream.open) > i {
+		e := stream.open[len(stream.open)-1]
+		stream.open = stream.open[:len(stream.open)-1]
+		if err := stream.close(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close ends an element opened by start.
+func (stream *tokenStream) close(e *streamElement) error {
+	if e.inert {
+		return nil
+	}
+	if e.skip {
+		stream.skip--
+		return nil
+	}
+	if e.marked {
+		// The marker is dropped if the element had no text.
+		defer func() { stream.ctx.pendingLang = "" }()
+	}
+
+	if e.pre {
+		defer func() { stream.ctx.isPre = false }()
+	}
+
+	ctx := stream.ctx
+	node := e.node
+	if e.kind != 0 {
+		// The markers of emphasis without text are emitted together.
+		if err := ctx.emit(stream.pendingOpen + e.close); err != nil {
+			return err
+		}
+		stream.pendingOpen = ""
+		ctx.emphasis &^= e.kind
+		if ctx.emphasis == 0 {
+			if err := stream.endText(false); err != nil {
+				return err
+			}
+		}
+	} else if atomIn(node.DataAtom, streamedElements) {
+		if err := stream.endText(!atomIn(node.DataAtom, blockElements)); err != nil {
+			return err
+		}
+	}
+
+	switch node.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.Legend:
+		// The text is kept for the slug of HeadingAnchors.
+		node.AppendChild(&html.Node{Type: html.TextNode, Data: e.text.String()})
+		stream.ctx = e.parent
+		return e.parent.emitHeading(node, ctx.buf.String())
+
+	case atom.P:
+		// Like FromReader, a paragraph that makes up a whole list item is only
+		// followed by the line break that ends the item. Its break is held
+		// back until more content of the item shows it doesn't.
+		if n := len(stream.open); e.first && n > 0 && stream.open[n-1].node.DataAtom == atom.Li {
+			stream.open[n-1].held = true
+			return nil
+		}
+		return ctx.emit("\n\n")
+
+	case atom.Ul, atom.Ol, atom.Blockquote, atom.Table, atom.Fieldset:
+		return ctx.emit("\n\n")
+
+	case atom.Pre:
+		ctx.isPre = false
+		stream.trimNewline = false
+		return ctx.emit("\n\n")
+
+	case atom.Div, atom.Tr:
+		return ctx.emit("\n")
+
+	case atom.Li:
+		ctx.afterListMarker = false
+		ctx.lineWrapper.indent = e.indent
+		return ctx.emit("\n")
+
+	case atom.A:
+		if e.href != "" && ctx.options.ReferenceLinks && !ctx.options.TextOnly {
+			return ctx.emit("][" + strconv.Itoa(ctx.linkCtx.reference(e.href)) + "]")
+		}
+		if ctx.options.LinkPlacement == LinkBeforeText {
+			return nil
+		}
+		node.AppendChild(&html.Node{Type: html.TextNode, Data: e.text.String()})
+		return ctx.emitLinkHref(node, e.href)
+	}
+	return nil
+}
+
+// streamedElements are the elements that a tokenStream renders more of than
+// their text, at their start or end tags.
+var streamedElements = []atom.Atom{
+	atom.A, atom.Blockquote, atom.Br, atom.Div, atom.Fieldset, atom.H1, atom.H2, atom.H3, atom.Img,
+	atom.Input, atom.Legend, atom.Li, atom.Ol, atom.P, atom.Pre, atom.Table, atom.Td, atom.Th,
+	atom.Tr, atom.Ul,
+}
+
+// isVoidElement reports whether elements of a have no content or end tag.
+func isVoidElement(a atom.Atom) bool {
+	switch a {
+	case atom.Area, atom.Base, atom.Br, atom.Col, atom.Embed, atom.Hr, atom.Img, atom.Input,
+		atom.Link, atom.Meta, atom.Param, atom.Source, atom.Track, atom.Wbr:
+		return true
+	}
+	return false
+}
+
+// hasBlockChild reports whether node has a child element that renders as a
+// block, such as a div or a paragraph.
+func hasBlockChild(node *html.Node) bool {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if isBlockNode(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlockNode reports whether node is an element that renders as a block.
+func isBlockNode(node *html.Node) bool {
+	return node.Type == html.ElementNode && atomIn(node.DataAtom, blockElements)
+}
+
+// blockElements are the elements rendered as blocks, separated from the
+// content around them by line breaks.
+var blockElements = []atom.Atom{
+	atom.Article, atom.Aside, atom.Blockquote, atom.Details, atom.Div, atom.Dl, atom.Fieldset,
+	atom.Figure, atom.Footer, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Header,
+	atom.Hr, atom.Li, atom.Ol, atom.P, atom.Pre, atom.Section, atom.Table, atom.Ul,
+}
+
+// atomIn reports whether a is one of atoms.
+func atomIn(a atom.Atom, atoms []atom.Atom) bool {
+	for _, b := range atoms {
+		if a == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Warning describes content that was dropped or couldn't be rendered
+// faithfully. Unlike errors, warnings don't stop the conversion.
+type Warning struct {
+	Node    *html.Node // Node the warning is about
+	Message string
+}
+
+func (w Warning) String() string {
+	return w.Message
+}
+
+var (
+	newlineRe = regexp.MustCompile(`\n\n+`)
+)
+
+// htmlEscaper escapes the text output for Options.HTMLEntitiesInOutput.
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// ellipsis is appended to output that was truncated to Options.MaxLength.
+const ellipsis = "..."
+
+// emptyParagraph marks the line of an empty paragraph kept by
+// Options.PreserveEmptyParagraphs. The parser replaces NUL characters in the
+// input, so it can't be confused with any text.
+const emptyParagraph = "\x00"
+
+// urlBreak marks where a URL may be wrapped with Options.WrapURLs. Like
+// emptyParagraph, it can't be confused with any text.
+const urlBreak = "\x00\x00"
+
+// urlContinuation ends the lines that a URL is wrapped after with
+// Options.WrapURLs, so that the break isn't mistaken for the end of the URL.
+const urlContinuation = "\\"
+
+// collapseText trims the raw traversal output and collapses blank lines.
+func collapseText(raw string) string {
+	text := newlineRe.ReplaceAllString(raw, "\n\n")
+	if strings.Contains(text, emptyParagraph) {
+		// URL breaks are removed first, as they may end a line.
+		text = strings.ReplaceAll(text, urlBreak, "")
+		// Dropping the line of each empty paragraph leaves an extra blank
+		// line in its place.
+		text = strings.ReplaceAll(text, emptyParagraph+"\n", "")
+		text = strings.ReplaceAll(text, emptyParagraph, "")
+	}
+	return strings.TrimSpace(text)
+}
+
+// ErrMalformedTable is returned when Options.StrictTables is set and a table
+// row spans a different number of columns than the first row.
+var ErrMalformedTable = errors.New("html2text: malformed table")
+
+// ErrCyclicTree is returned by FromHTMLNode when a node can be reached more than
+// once from the document, such as through cyclic NextSibling pointers.
+var ErrCyclicTree = errors.New("html2text: node tree contains a cycle")
+
+// checkNodeTree returns ErrCyclicTree if any node is reachable more than once
+// from doc through child and sibling pointers, or if the parent pointers of a
+// node lead back to it, as they are followed to find inherited attributes.
+func checkNodeTree(doc *html.Node) error {
+	visited := map[*html.Node]struct{}{}
+	stack := []*html.Node{doc}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			if _, ok := visited[c]; ok || c == doc {
+				return ErrCyclicTree
+			}
+			visited[c] = struct{}{}
+			stack = append(stack, c)
+		}
+	}
+
+	// Each node's ancestors are walked until reaching one known to have no
+	// cycle above it.
+	acyclic := map[*html.Node]bool{}
+	visited[doc] = struct{}{}
+	for node := range visited {
+		var path []*html.Node
+		onPath := map[*html.Node]bool{}
+		for p := node; p != nil && !acyclic[p]; p = p.Parent {
+			if onPath[p] {
+				return ErrCyclicTree
+			}
+			onPath[p] = true
+			path = append(path, p)
+		}
+		for _, p := range path {
+			acyclic[p] = true
+		}
+	}
+	return nil
+}
+
+// ErrMaxDepth is returned when the document is nested deeper than
+// Options.MaxDepth.
+var ErrMaxDepth = errors.New("html2text: maximum nesting depth exceeded")
+
+// traverseTableCtx holds text-related context.
+type textifyTraverseContext struct {
+	buf strings.Builder
+
+	prefix          string
+	tableCtx        tableTraverseContext
+	listCtx         listTraverseContext
+	linkCtx         *linkTraverseContext
+	headingCtx      *headingTraverseContext
+	emphasis        emphasis
+	blockEmphasis   emphasis // style emphasis of an ancestor with block content, applied to inline content
+	options         Options
+	endsWithSpace   bool
+	justClosedDiv   bool
+	afterListMarker bool // nothing was emitted since the last list item marker
+	afterHeading    bool // nothing was emitted since the spacing after the last heading
+	blockquoteLevel int
+	tableLevel      int
+	tableCount      *int // tables seen so far, shared with sub-contexts and table cells
+	paragraphCount  *int // numbered paragraphs so far, shared with sub-contexts and table cells
+	lineWrapper     lineWrapper
+	isPre           bool
+	depth           int
+	tableSpans      [][2]int   // byte ranges of rendered tables within buf
+	warnings        *[]Warning // collects warnings if non-nil, shared with sub-contexts
+	uppercase       bool       // uppercases text, such as for UppercaseHeadings
+	pendingLang     string     // ShowLang markers to emit before the next text
+}
+
+// tableTraverseContext holds table ASCII-form related context.
+type tableTraverseContext struct {
+	header     []string
+	body       [][]string
+	footer     []string
+	tmpRow     int
+	isInHeader bool
+	isInFooter bool
+
+	index    int   // 1-based position of the table in the document
+	rows     int   // number of rows seen so far
+	columns  int   // number of columns spanned by the first row
+	rowSpans []int // rows left for cells spanning down, by column
+
+	columnAlign []int // alignment declared by col elements, by column
+}
+
+func (tableCtx *tableTraverseContext) init(index int) {
+	tableCtx.body = [][]string{}
+	tableCtx.header = []string{}
+	tableCtx.footer = []string{}
+	tableCtx.isInHeader = false
+	tableCtx.isInFooter = false
+	tableCtx.tmpRow = 0
+	tableCtx.index = index
+	tableCtx.rows = 0
+	tableCtx.columns = 0
+	tableCtx.rowSpans = nil
+	tableCtx.columnAlign = nil
+}
+
+// allRows returns the non-empty header, body and footer rows of the table, in
+// that order.
+func (tableCtx *tableTraverseContext) allRows() [][]string {
+	rows := make([][]string, 0, len(tableCtx.body)+2)
+	for _, row := range append(append([][]string{tableCtx.header}, tableCtx.body...), tableCtx.footer) {
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// columnCount returns the number of columns of the widest row of the table.
+func (tableCtx *tableTraverseContext) columnCount() int {
+	var columns int
+	for _, row := range tableCtx.allRows() {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	return columns
+}
+
+// padRow returns row with empty cells appended up to the given number of
+// columns, unless it is empty.
+func padRow(row []string, columns int) []string {
+	if len(row) == 0 {
+		return row
+	}
+	for len(row) < columns {
+		row = append(row, "")
+	}
+	return row
+}
+
+// addColumns records the alignment of the columns of colgroup, declared by its
+// col children, or by colgroup itself if it has none.
+func (tableCtx *tableTraverseContext) addColumns(colgroup *html.Node) {
+	align := columnAlignment(colgroup, tablewriter.ALIGN_DEFAULT)
+	if countChildElements(colgroup, atom.Col) == 0 {
+		for i := spanAttrVal(colgroup, "span"); i > 0; i-- {
+			tableCtx.columnAlign = append(tableCtx.columnAlign, align)
+		}
+		return
+	}
+
+	for c := colgroup.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Col {
+			colAlign := columnAlignment(c, align)
+			for i := spanAttrVal(c, "span"); i > 0; i-- {
+				tableCtx.columnAlign = append(tableCtx.columnAlign, colAlign)
+			}
+		}
+	}
+}
+
+// columnAlignment returns the tablewriter alignment declared by the align
+// attribute or text-align style of a col or colgroup element, or def if there
+// is none.
+func columnAlignment(node *html.Node, def int) int {
+	align := styleProperty(node, "text-align")
+	if align == "" {
+		align = strings.ToLower(strings.TrimSpace(getAttrVal(node, "align")))
+	}
+
+	switch align {
+	case "left", "start":
+		return tablewriter.ALIGN_LEFT
+	case "center":
+		return tablewriter.ALIGN_CENTER
+	case "right", "end":
+		return tablewriter.ALIGN_RIGHT
+	}
+	return def
+}
+
+// checkRow returns an error if row doesn't span as many columns as the first
+// row of the table did.
+func (tableCtx *tableTraverseContext) checkRow(row *html.Node) error {
+	tableCtx.rows++
+
+	columns := tableCtx.rowColumns(row)
+	if tableCtx.rows == 1 {
+		tableCtx.columns = columns
+		return nil
+	}
+
+	if columns != tableCtx.columns {
+		return fmt.Errorf("%w: table %d row %d spans %d columns, expected %d",
+			ErrMalformedTable, tableCtx.index, tableCtx.rows, columns, tableCtx.columns)
+	}
+	return nil
+}
+
+// rowColumns returns the number of columns spanned by row, including the
+// cells of previous rows spanning down into it.
+func (tableCtx *tableTraverseContext) rowColumns(row *html.Node) int {
+	spans := tableCtx.rowSpans
+	next := make([]int, len(spans))
+	for i, n := range spans {
+		if n > 0 {
+			next[i] = n - 1
+		}
+	}
+
+	col := 0
+	for c := row.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || (c.DataAtom != atom.Td && c.DataAtom != atom.Th) {
+			continue
+		}
+
+		// Skip the columns taken by cells spanning down from above.
+		for col < len(spans) && spans[col] > 0 {
+			col++
+		}
+
+		colspan := spanAttrVal(c, "colspan")
+		rowspan := spanAttrVal(c, "rowspan")
+		for i := 0; i < colspan; i++ {
+			for col >= len(next) {
+				next = append(next, 0)
+			}
+			next[col] = rowspan - 1
+			col++
+		}
+	}
+
+	columns := col
+	for i := col; i < len(spans); i++ {
+		if spans[i] > 0 {
+			columns = i + 1
+		}
+	}
+
+	tableCtx.rowSpans = next
+	return columns
+}
+
+// emphasis is a set of the kinds of emphasis surrounding the traversed node.
+type emphasis uint8
+
+const (
+	emphasisBold emphasis = 1 << iota
+	emphasisItalic
+)
+
+// listTraverseContext holds list numbering context.
+type listTraverseContext struct {
+	ordered  bool
+	reversed bool
+	number   int
+}
+
+func (listCtx *listTraverseContext) init(node *html.Node) {
+	listCtx.ordered = node.DataAtom == atom.Ol
+	listCtx.reversed = listCtx.ordered && hasAttr(node, "reversed")
+
+	start, err := strconv.Atoi(strings.TrimSpace(getAttrVal(node, "start")))
+	switch {
+	case err == nil:
+		listCtx.number = start
+	case listCtx.reversed:
+		// Reversed lists count down to 1 by default.
+		listCtx.number = countChildElements(node, atom.Li)
+	default:
+		listCtx.number = 1
+	}
+}
+
+// marker returns the marker for the list item li and advances the counter. The
+// value attribute of li, if any, resets the counter.
+func (listCtx *listTraverseContext) marker(li *html.Node) string {
+	if !listCtx.ordered {
+		return "- "
+	}
+
+	if value, err := strconv.Atoi(strings.TrimSpace(getAttrVal(li, "value"))); err == nil {
+		listCtx.number = value
+	}
+
+	marker := strconv.Itoa(listCtx.number) + ". "
+	if listCtx.reversed {
+		listCtx.number--
+	} else {
+		listCtx.number++
+	}
+	return marker
+}
+
+// linkTraverseContext holds link context shared with sub-contexts.
+type linkTraverseContext struct {
+	recent     []string        // hrefs of the most recent links, oldest first
+	references []string        // hrefs of reference-style links, in order of their numbers
+	anchors    map[string]bool // anchors emitted for headings
+	ids        map[string]bool // explicit ids of the document, which generated anchors avoid
+	root       *html.Node      // root of the rendered document, if it is a tree
+}
+
+// anchor records slug as an anchor generated for a heading, returning it with
+// a numeric suffix if it was already taken or is an explicit id.
+func (linkCtx *linkTraverseContext) anchor(slug string) string {
+	if linkCtx.anchors == nil {
+		linkCtx.anchors = make(map[string]bool)
+	}
+	unique := slug
+	for i := 1; linkCtx.anchors[unique] || linkCtx.ids[unique]; i++ {
+		unique = slug + "-" + strconv.Itoa(i)
+	}
+	linkCtx.anchors[unique] = true
+	return unique
+}
+
+// explicitAnchor records the explicit id of a heading as an anchor, which is
+// kept as is since it is a target of links into the document.
+func (linkCtx *linkTraverseContext) explicitAnchor(id string) string {
+	if linkCtx.anchors == nil {
+		linkCtx.anchors = make(map[string]bool)
+	}
+	linkCtx.anchors[id] = true
+	return id
+}
+
+// collectIDs records the ids of the elements in the document containing node,
+// unless they were already collected. The document ends at the root being
+// rendered, as the nodes outside of it weren't checked by checkNodeTree.
+func (linkCtx *linkTraverseContext) collectIDs(node *html.Node) {
+	if linkCtx.ids != nil {
+		return
+	}
+	for node != linkCtx.root && node.Parent != nil {
+		node = node.Parent
+	}
+
+	linkCtx.ids = make(map[string]bool)
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if id := strings.TrimSpace(getAttrVal(n, "id")); id != "" {
+				linkCtx.ids[id] = true
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(node)
+}
+
+// reference returns the number of the reference-style link to href, adding it
+// to the references if it isn't already among them.
+func (linkCtx *linkTraverseContext) reference(href string) int {
+	for i, reference := range linkCtx.references {
+		if reference == href {
+			return i + 1
+		}
+	}
+	linkCtx.references = append(linkCtx.references, href)
+	return len(linkCtx.references)
+}
+
+// seen records href as the most recent link and reports whether it was
+// already among the last window links.
+func (linkCtx *linkTraverseContext) seen(href string, window int) bool {
+	if window <= 0 {
+		return false
+	}
+
+	var seen bool
+	for _, recent := range linkCtx.recent {
+		if recent == href {
+			seen = true
+			break
+		}
+	}
+
+	linkCtx.recent = append(linkCtx.recent, href)
+	if len(linkCtx.recent) > window {
+		linkCtx.recent = linkCtx.recent[len(linkCtx.recent)-window:]
+	}
+	return seen
+}
+
+// headingTraverseContext holds heading context shared with sub-contexts.
+type headingTraverseContext struct {
+	counts [6]int // number of headings at each level since the last heading of a higher level
+	top    int    // highest level of the headings so far, 1 for h1, or 0 if there were none
+}
+
+// number counts a heading of the given level, from 1 for h1 to 6 for h6, and
+// returns its hierarchical number, such as "1.2" for the second heading below
+// the first top-level heading. A heading of a higher level than any before it
+// becomes the top level, continuing the count of the previous one.
+func (headingCtx *headingTraverseContext) number(level int) string {
+	if headingCtx.top == 0 {
+		headingCtx.top = level
+	} else if level < headingCtx.top {
+		headingCtx.counts[level-1] = headingCtx.counts[headingCtx.top-1]
+		headingCtx.top = level
+	}
+	headingCtx.counts[level-1]++
+	for i := level; i < len(headingCtx.counts); i++ {
+		headingCtx.counts[i] = 0
+	}
+
+	parts := make([]string, 0, level-headingCtx.top+1)
+	for _, count := range headingCtx.counts[headingCtx.top-1 : level] {
+		parts = append(parts, strconv.Itoa(count))
+	}
+	return strings.Join(parts, ".")
+}
+
+// lineWidth is the width lines are wrapped to, Indent included.
+const lineWidth = 78
+
+func newTextifyTraverseContext(options Options, depth int) *textifyTraverseContext {
+	ctx := &textifyTraverseContext{
+		options:        options,
+		depth:          depth,
+		linkCtx:        &linkTraverseContext{},
+		headingCtx:     &headingTraverseContext{},
+		tableCount:     new(int),
+		paragraphCount: new(int),
+	}
+	ctx.lineWrapper = lineWrapper{
+		out:       &ctx.buf,
+		width:     lineWidth - options.Indent,
+		keepNBSP:  options.KeepNBSP,
+		sentences: options.SentencePerLine,
+	}
+	if options.SentencePerLine {
+		ctx.lineWrapper.width = math.MaxInt32
+	}
+	return ctx
+}
+
+// text returns the final text output of the traversal.
+func (ctx *textifyTraverseContext) text() string {
+	return collapseText(ctx.buf.String())
+}
+
+// truncatedText returns the final text output cut down so that it is at most
+// maxLength runes long once transformed by finalText, ellipsis included. The
+// text is cut at the end of the last word that fits, or within the word if it
+// is the first. A table is never cut in half: if the limit falls within one,
+// the output stops before the table and the ellipsis is put on its own line.
+// The list of reference links is left out if there is no room for it at all.
+func (ctx *textifyTraverseContext) truncatedText(maxLength int) string {
+	raw := ctx.buf.String()
+	offsets := make([]int, 0, len(raw)+1)
+	for i := range raw {
+		offsets = append(offsets, i)
+	}
+	offsets = append(offsets, len(raw))
+
+	references := true
+	fits := func(text string) bool {
+		return utf8.RuneCountInString(ctx.finalText(text+ellipsis, references)) <= maxLength
+	}
+	if !fits("") {
+		references = false
+		if !fits("") {
+			text := []rune(ctx.finalText(ellipsis, false))
+			return string(text[:maxLength])
+		}
+	}
+
+	// Find the longest raw prefix that fits once collapsed. The collapsed
+	// length never shrinks as the prefix grows, so a binary search works.
+	n := sort.Search(len(offsets), func(i int) bool {
+		return !fits(collapseText(raw[:offsets[i]]))
+	})
+	cut := offsets[n-1]
+
+	for _, span := range ctx.tableSpans {
+		if span[0] < cut && cut < span[1] {
+			return ctx.finalText(collapseText(raw[:span[0]])+"\n"+ellipsis, references)
+		}
+	}
+
+	// Back off to the end of the last word that fits, unless it is the first.
+	if r, _ := utf8.DecodeRuneInString(raw[cut:]); !unicode.IsSpace(r) {
+		if i := strings.LastIndexFunc(raw[:cut], unicode.IsSpace); i >= 0 && strings.TrimSpace(raw[:i]) != "" {
+			cut = i
+		}
+	}
+
+	// The ellipsis is put on its own line if the text is cut between blocks.
+	text := collapseText(raw[:cut])
+	if strings.HasPrefix(raw[cut:], "\n") && fits(text+"\n") {
+		text += "\n"
+	}
+	return ctx.finalText(text+ellipsis, references)
+}
+
+func (ctx *textifyTraverseContext) sub() *textifyTraverseContext {
+	subCtx := textifyTraverseContext{}
+	subCtx.options = ctx.options
+	subCtx.depth = ctx.depth
+	subCtx.linkCtx = ctx.linkCtx
+	subCtx.headingCtx = ctx.headingCtx
+	subCtx.emphasis = ctx.emphasis
+	subCtx.blockEmphasis = ctx.blockEmphasis
+	subCtx.isPre = ctx.isPre
+	subCtx.warnings = ctx.warnings
+	subCtx.uppercase = ctx.uppercase
+	subCtx.tableCount = ctx.tableCount
+	subCtx.paragraphCount = ctx.paragraphCount
+	subCtx.lineWrapper = lineWrapper{
+		out:       &subCtx.buf,
+		width:     ctx.lineWrapper.width,
+		keepNBSP:  ctx.lineWrapper.keepNBSP,
+		sentences: ctx.lineWrapper.sentences,
+	}
+	return &subCtx
+}
+
+func (ctx *textifyTraverseContext) handleElement(node *html.Node) error {
+	ctx.justClosedDiv = false
+
+	if ctx.skipsElement(node) {
+		ctx.trace(node, TraceSkip)
+		return nil
+	}
+
+	if ctx.options.ShowLang {
+		if marker := langMarker(node, inheritedLang(node)); marker != "" {
+			ctx.pendingLang += marker
+			// The marker is dropped if the element has no text.
+			defer func() { ctx.pendingLang = "" }()
+		}
+	}
+
+	if !ctx.isPre && isPreStyle(node) {
+		ctx.isPre = true
+		defer func() { ctx.isPre = false }()
+	}
+
+	switch node.DataAtom {
+	case atom.Br:
+		return ctx.lineBreak()
+
+	case atom.H1, atom.H2, atom.H3, atom.Legend:
+		return ctx.headingHandler(node)
+
+	case atom.Fieldset:
+		return ctx.paragraphHandler(node)
+
+	case atom.Select:
+		return ctx.selectHandler(node)
+
+	case atom.Ruby:
+		return ctx.rubyHandler(node)
+
+	case atom.Button:
+		if !ctx.options.RenderFormControls || ctx.options.TextOnly {
+			return ctx.traverseChildren(node)
+		}
+		return ctx.wrapHandler(node, "[", "]")
+
+	case atom.Input:
+		if !ctx.options.RenderFormControls {
+			return nil
+		}
+		return ctx.inputHandler(node)
+
+	case atom.Summary:
+		// Summaries of details elements are rendered by detailsHandler, so
+		// this is one without a details parent, rendered as a plain line.
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		return ctx.emit("\n")
+
+	case atom.Details:
+		return ctx.detailsHandler(node)
+
+	case atom.Blockquote:
+		ctx.blockquoteLevel++
+		if !ctx.options.TextOnly {
+			ctx.prefix = strings.Repeat(">", ctx.blockquoteLevel) + " "
+		}
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+		if ctx.blockquoteLevel == 1 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		if err := ctx.blockquoteContent(node); err != nil {
+			return err
+		}
+		ctx.blockquoteLevel--
+		if !ctx.options.TextOnly {
+			ctx.prefix = strings.Repeat(">", ctx.blockquoteLevel)
+		}
+		if ctx.blockquoteLevel > 0 {
+			ctx.prefix += " "
+		}
+		return ctx.emit("\n\n")
+
+	case atom.Div:
+		if !ctx.afterListMarker {
+			ctx.lineWrapper.flush()
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		var err error
+		if !ctx.justClosedDiv {
+			err = ctx.emit("\n")
+		}
+		ctx.justClosedDiv = true
+		return err
+
+	case atom.Li:
+		return ctx.listItemHandler(node)
+
+	case atom.B, atom.Strong:
+		return ctx.emphasisHandler(node, emphasisBold)
+
+	case atom.Em, atom.I:
+		return ctx.emphasisHandler(node, emphasisItalic)
+
+	case atom.Dfn:
+		// The defining instance of a term is emphasized, followed by its
+		// title, which may give its full form.
+		if err := ctx.emphasisHandler(node, emphasisItalic); err != nil {
+			return err
+		}
+		title := strings.Join(strings.Fields(getAttrVal(node, "title")), " ")
+		if title == "" || title == strings.Join(strings.Fields(textContent(node)), " ") {
+			return nil
+		}
+		return ctx.emit(" (" + title + ")")
+
+	case atom.Data:
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		// The machine-readable value is only worth showing when it differs
+		// from the text.
+		value := strings.TrimSpace(getAttrVal(node, "value"))
+		if !ctx.options.DataValues || value == "" || value == strings.TrimSpace(textContent(node)) {
+			return nil
+		}
+		return ctx.emit(" (" + value + ")")
+
+	case atom.Time:
+		if ctx.options.TimeFormatter == nil {
+			return ctx.traverseChildren(node)
+		}
+		return ctx.timeHandler(node)
+
+	case atom.Bdi, atom.Bdo:
+		if !ctx.options.BidiControls {
+			return ctx.traverseChildren(node)
+		}
+
+		subCtx := ctx.sub()
+		subCtx.endsWithSpace = true
+		if err := subCtx.traverseChildren(node); err != nil {
+			return err
+		}
+		open, close := bidiControls(node)
+		lead, trail := ctx.inlineSpace(node)
+		return ctx.emit(lead + open + subCtx.buf.String() + close + trail)
+
+	case atom.Progress, atom.Meter:
+		if !ctx.options.RenderGauges || !hasAttr(node, "value") {
+			return ctx.traverseChildren(node)
+		}
+		return ctx.emit(ctx.renderGauge(node))
+
+	case atom.A:
+		return ctx.linkHandler(node)
+
+	case atom.Img:
+		return ctx.imageHandler(node)
+
+	case atom.Ul, atom.Ol:
+		listCtx := ctx.listCtx
+		defer func() { ctx.listCtx = listCtx }()
+
+		ctx.listCtx.init(node)
+		return ctx.paragraphHandler(node)
+
+	case atom.P:
+		if ctx.options.PreserveEmptyParagraphs && isEmptyParagraph(node) {
+			if err := ctx.emit("\n\n"); err != nil {
+				return err
+			}
+			if err := ctx.emit(emptyParagraph); err != nil {
+				return err
+			}
+			return ctx.emit("\n\n")
+		}
+		return ctx.paragraphHandler(node)
+
+	case atom.Table:
+		if err := ctx.emitTablePreamble(node); err != nil {
+			return err
+		}
 
-	case atom.Table:
 		ctx.tableLevel++
 		defer func() { ctx.tableLevel-- }()
 
-		fallthrough
-	case atom.Tfoot, atom.Th, atom.Tr, atom.Td:
-		if ctx.options.PrettyTables {
-			return ctx.handleTableElement(node)
-		} else if node.DataAtom == atom.Table {
-			return ctx.paragraphHandler(node)
+		fallthrough
+	case atom.Thead, atom.Tbody, atom.Tfoot, atom.Th, atom.Tr, atom.Td, atom.Colgroup:
+		if ctx.collectsTables() {
+			return ctx.handleTableElement(node)
+		} else if node.DataAtom == atom.Table {
+			return ctx.plainTableHandler(node)
+		}
+		return ctx.traverseChildren(node)
+
+	case atom.Pre:
+		isPre := ctx.isPre
+		defer func() { ctx.isPre = isPre }()
+
+		if ctx.options.CodeFences && !ctx.options.TextOnly {
+			return ctx.codeBlockHandler(node)
+		}
+		ctx.isPre = true
+		if err := ctx.emit("\n\n"); err != nil {
+			return err
+		}
+		if err := ctx.preChildrenHandler(node); err != nil {
+			return err
+		}
+		return ctx.emit("\n\n")
+
+	case atom.Code, atom.Tt:
+		// Code within a pre element is part of its block, which is fenced
+		// on its own.
+		if ctx.isPre || !ctx.options.CodeFences || ctx.options.TextOnly {
+			return ctx.traverseChildren(node)
+		}
+		return ctx.inlineCodeHandler(node)
+
+	case atom.Kbd:
+		// A kbd containing kbd elements is a combination of the keys within
+		// it, which are marked up on their own.
+		if ctx.isPre || !ctx.options.CodeFences || ctx.options.TextOnly || hasChildElement(node, atom.Kbd) {
+			return ctx.traverseChildren(node)
+		}
+		return ctx.inlineCodeHandler(node)
+
+	case atom.Small:
+		if !ctx.options.ParenthesizeSmall || ctx.options.TextOnly {
+			return ctx.traverseChildren(node)
+		}
+		if d := ctx.options.SmallDelimiters; d != [2]string{} {
+			return ctx.wrapHandler(node, d[0], d[1])
+		}
+		return ctx.wrapHandler(node, "(", ")")
+
+	case atom.Head:
+		if ctx.options.EmitTitle {
+			if err := ctx.titleHandler(node); err != nil {
+				return err
+			}
+		}
+		// Ignore the rest of the subtree.
+		ctx.trace(node, TraceSkip)
+		return nil
+
+	case atom.Style, atom.Script:
+		// Ignore the subtree.
+		ctx.trace(node, TraceSkip)
+		ctx.warn(node, "skipped <%s> element", node.Data)
+		return nil
+
+	case atom.Template:
+		// Template content is inert, so it isn't rendered by browsers either.
+		ctx.trace(node, TraceSkip)
+		return nil
+
+	case atom.Noscript:
+		if ctx.options.SkipNoscript {
+			ctx.trace(node, TraceSkip)
+			return nil
+		}
+		return ctx.noscriptHandler(node)
+
+	default:
+		return ctx.traverseChildren(node)
+	}
+}
+
+// timeHandler renders the datetime of a time element formatted by the
+// TimeFormatter option, which is the text of the element if it has no datetime
+// attribute. The text is rendered as is if the datetime can't be formatted.
+// With AppendFormattedTime, the formatted datetime follows the text in
+// parentheses instead of replacing it.
+func (ctx *textifyTraverseContext) timeHandler(node *html.Node) error {
+	text := strings.TrimSpace(textContent(node))
+	datetime := text
+	if hasAttr(node, "datetime") {
+		datetime = strings.TrimSpace(getAttrVal(node, "datetime"))
+	}
+
+	formatted := ctx.options.TimeFormatter(datetime)
+	if formatted == "" || formatted == datetime {
+		return ctx.traverseChildren(node)
+	}
+
+	if ctx.options.AppendFormattedTime {
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		if formatted == text {
+			return nil
+		}
+		return ctx.emit(" (" + formatted + ")")
+	}
+
+	lead, trail := ctx.inlineSpace(node)
+	return ctx.emit(lead + ctx.transformText(formatted) + trail)
+}
+
+// blockquoteContent renders the children of a blockquote. With
+// BlockquoteAttribution, a trailing footer or cite element is rendered after
+// the quote as an attribution line starting with an em dash.
+func (ctx *textifyTraverseContext) blockquoteContent(node *html.Node) error {
+	attribution := lastElementChild(node)
+	if !ctx.options.BlockquoteAttribution || attribution == nil ||
+		(attribution.DataAtom != atom.Footer && attribution.DataAtom != atom.Cite) {
+		return ctx.traverseChildren(node)
+	}
+
+	for c := node.FirstChild; c != attribution; c = c.NextSibling {
+		if err := ctx.traverse(c); err != nil {
+			return err
+		}
+	}
+
+	subCtx := ctx.sub()
+	if err := subCtx.traverseChildren(attribution); err != nil {
+		return err
+	}
+	// The dash the author may have written is replaced by our own.
+	text := strings.TrimLeft(strings.TrimSpace(subCtx.buf.String()), "—–-~ ")
+	if text == "" {
+		return nil
+	}
+	if err := ctx.emit("\n"); err != nil {
+		return err
+	}
+	return ctx.emit("— " + text)
+}
+
+// noscriptHandler renders the fallback content of a noscript element. As the
+// parser treats scripts as enabled, the content is left as unparsed markup,
+// which is parsed as if it were in place of the noscript element.
+func (ctx *textifyTraverseContext) noscriptHandler(node *html.Node) error {
+	text := node.FirstChild
+	if text == nil || text != node.LastChild || text.Type != html.TextNode {
+		return ctx.traverseChildren(node)
+	}
+	return ctx.renderMarkup(text.Data, node.Parent)
+}
+
+// renderMarkup parses markup as the content of the element parent, or of a
+// body element if it is nil, and renders the resulting nodes.
+func (ctx *textifyTraverseContext) renderMarkup(markup string, parent *html.Node) error {
+	if parent == nil || parent.Type != html.ElementNode {
+		parent = &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: "body"}
+	}
+	nodes, err := html.ParseFragment(strings.NewReader(markup), parent)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		if err := ctx.traverse(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// titleHandler renders the title of the document found in head as an h1
+// heading, which isn't numbered along with the headings of the body.
+func (ctx *textifyTraverseContext) titleHandler(head *html.Node) error {
+	var title string
+	for c := head.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Title {
+			title = strings.Join(strings.Fields(textContent(c)), " ")
+			break
+		}
+	}
+	if title == "" {
+		return nil
+	}
+
+	h1 := &html.Node{Type: html.ElementNode, DataAtom: atom.H1, Data: "h1"}
+	h1.AppendChild(&html.Node{Type: html.TextNode, Data: title})
+
+	options := ctx.options
+	defer func() { ctx.options = options }()
+	ctx.options.HeadingNumbering = false
+	return ctx.headingHandler(h1)
+}
+
+// inputHandler renders the label of an image or button input, or else a
+// representation of the field, such as "[____]" for an empty text field, set
+// apart by spaces from the label text around it.
+func (ctx *textifyTraverseContext) inputHandler(node *html.Node) error {
+	var label string
+	switch typ := strings.ToLower(strings.TrimSpace(getAttrVal(node, "type"))); typ {
+	case "image":
+		label = getAttrVal(node, "alt")
+	case "submit", "reset", "button":
+		label = getAttrVal(node, "value")
+	case "hidden":
+		return nil
+	case "checkbox", "radio":
+		// Task list items already render their checkbox in the marker.
+		if ctx.options.TextOnly || isTaskCheckbox(node) {
+			return nil
+		}
+		checked := hasAttr(node, "checked")
+		switch {
+		case typ == "radio" && checked:
+			return ctx.emit(" (*) ")
+		case typ == "radio":
+			return ctx.emit(" ( ) ")
+		case checked:
+			return ctx.emit(" [x] ")
+		}
+		return ctx.emit(" [ ] ")
+	default:
+		if ctx.options.TextOnly {
+			return nil
+		}
+		value := strings.Join(strings.Fields(getAttrVal(node, "value")), " ")
+		if value == "" || typ == "password" {
+			value = "____"
+		}
+		return ctx.emit(" [" + value + "] ")
+	}
+
+	if label = strings.Join(strings.Fields(label), " "); label == "" {
+		return nil
+	}
+	if ctx.options.TextOnly {
+		return ctx.emit(label)
+	}
+	return ctx.emit("[" + label + "]")
+}
+
+// rubyHandler renders the base text of a ruby element, each followed by its
+// annotation in parentheses. The parentheses given by rp elements for browsers
+// without ruby support are used if present. With InlineRuby, annotations
+// directly follow their base text instead.
+func (ctx *textifyTraverseContext) rubyHandler(node *html.Node) error {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			if err := ctx.traverse(c); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch c.DataAtom {
+		case atom.Rp:
+			// Rendered along with the annotation it surrounds.
+		case atom.Rt:
+			open, close := "(", ")"
+			if ctx.options.InlineRuby {
+				open, close = "", ""
+			} else {
+				if rp := adjacentElement(c, atom.Rp, false); rp != nil {
+					open = strings.TrimSpace(textContent(rp))
+				}
+				if rp := adjacentElement(c, atom.Rp, true); rp != nil {
+					close = strings.TrimSpace(textContent(rp))
+				}
+			}
+			if err := ctx.emit(open); err != nil {
+				return err
+			}
+			if err := ctx.traverseChildren(c); err != nil {
+				return err
+			}
+			if err := ctx.emit(close); err != nil {
+				return err
+			}
+		default:
+			if err := ctx.traverse(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// adjacentElement returns the sibling element just before node, or just after
+// it if next is set, skipping whitespace, if it is an element of the given atom.
+func adjacentElement(node *html.Node, a atom.Atom, next bool) *html.Node {
+	sibling := func(n *html.Node) *html.Node {
+		if next {
+			return n.NextSibling
+		}
+		return n.PrevSibling
+	}
+
+	c := sibling(node)
+	for c != nil && c.Type == html.TextNode && strings.TrimSpace(c.Data) == "" {
+		c = sibling(c)
+	}
+	if c != nil && c.Type == html.ElementNode && c.DataAtom == a {
+		return c
+	}
+	return nil
+}
+
+// selectHandler renders the options of a select element on their own lines,
+// with the options of each labelled optgroup indented below its label.
+func (ctx *textifyTraverseContext) selectHandler(node *html.Node) error {
+	var lines []string
+	appendOptionLines(&lines, node, "")
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if err := ctx.emit("\n\n"); err != nil {
+		return err
+	}
+	// Lines are written verbatim to keep their indentation.
+	text := ctx.transformText(strings.Join(lines, "\n"))
+	if ctx.tableLevel > 0 {
+		ctx.buf.WriteString(text)
+	} else {
+		ctx.lineWrapper.writePre(text)
+	}
+	return ctx.emit("\n\n")
+}
+
+// appendOptionLines appends a line for each option and labelled optgroup within
+// node to lines, prefixed by indent.
+func appendOptionLines(lines *[]string, node *html.Node, indent string) {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+
+		switch c.DataAtom {
+		case atom.Option:
+			label := getAttrVal(c, "label")
+			if label == "" {
+				label = textContent(c)
+			}
+			if label = strings.Join(strings.Fields(label), " "); label != "" {
+				*lines = append(*lines, indent+label)
+			}
+
+		case atom.Optgroup:
+			label := strings.Join(strings.Fields(getAttrVal(c, "label")), " ")
+			if label == "" {
+				appendOptionLines(lines, c, indent)
+				continue
+			}
+			*lines = append(*lines, indent+label)
+			appendOptionLines(lines, c, indent+"  ")
+
+		default:
+			appendOptionLines(lines, c, indent)
+		}
+	}
+}
+
+// lineBreak renders a br element.
+func (ctx *textifyTraverseContext) lineBreak() error {
+	// A break on a line that has no text yet, such as at the start of a
+	// block or right after another break, would only add blank lines.
+	if ctx.tableLevel == 0 && !ctx.isPre && ctx.lineWrapper.n <= ctx.lineWrapper.indent {
+		return nil
+	}
+	return ctx.emit("\n\n")
+}
+
+// headingHandler renders node children as a heading underlined with a divider.
+func (ctx *textifyTraverseContext) headingHandler(node *html.Node) error {
+	subCtx := ctx.headingSub(node)
+	if err := subCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	return ctx.emitHeading(node, subCtx.buf.String())
+}
+
+// headingSub returns the sub-context rendering the content of a heading.
+func (ctx *textifyTraverseContext) headingSub(node *html.Node) *textifyTraverseContext {
+	subCtx := ctx.sub()
+	subCtx.uppercase = ctx.options.UppercaseHeadings
+	// Headings stand out by their divider already.
+	subCtx.blockEmphasis = 0
+	// The heading is wrapped to the width left by the current indentation and
+	// emitted line by line, so that the divider matches the rendered lines.
+	subCtx.lineWrapper.width -= ctx.lineWrapper.indent
+	// Legends caption their fieldset rather than starting a section.
+	if ctx.options.HeadingNumbering && node.DataAtom != atom.Legend {
+		subCtx.emit(ctx.headingCtx.number(headingLevel(node)) + " ")
+	}
+	return subCtx
+}
+
+// emitHeading emits the content of a heading rendered by the sub-context from
+// headingSub, followed by its divider. With HeadingAnchors, the last line ends
+// with an anchor formatted by HeadingAnchorFormat, or "{#{slug}}" if unset.
+func (ctx *textifyTraverseContext) emitHeading(node *html.Node, content string) error {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if ctx.options.HeadingAnchors && !ctx.options.TextOnly && len(lines) > 0 {
+		anchor := strings.ReplaceAll(defaultString(ctx.options.HeadingAnchorFormat, "{#{slug}}"), "{slug}", ctx.headingSlug(node))
+		lines[len(lines)-1] += " " + anchor
+	}
+
+	if ctx.options.TextOnly {
+		ctx.emit("\n\n")
+		ctx.emitLines(lines, "", "")
+		return ctx.emitHeadingSpacing()
+	}
+
+	dividerLen := 0
+	for _, line := range lines {
+		if lineLen := stringWidth(line); lineLen > dividerLen {
+			dividerLen = lineLen
+		}
+	}
+
+	var divider string
+	if node.DataAtom == atom.H1 {
+		divider = strings.Repeat("*", dividerLen)
+	} else {
+		divider = strings.Repeat("-", dividerLen)
+	}
+
+	ctx.emit("\n\n")
+
+	if node.DataAtom == atom.H1 && !ctx.options.OmitH1TopDivider {
+		ctx.emit(divider)
+		ctx.emit("\n")
+	}
+
+	if ctx.options.ANSIColors {
+		ctx.emitLines(lines, ansiBold, ansiNormalIntensity)
+	} else {
+		ctx.emitLines(lines, "", "")
+	}
+	ctx.emit("\n")
+
+	ctx.emit(divider)
+	return ctx.emitHeadingSpacing()
+}
+
+// emitHeadingSpacing ends a heading with the newlines of HeadingBottomSpacing,
+// which take the place of those starting the block that follows it.
+func (ctx *textifyTraverseContext) emitHeadingSpacing() error {
+	spacing := ctx.headingBottomSpacing()
+	if spacing == 1 {
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+	} else if err := ctx.emit("\n\n"); err != nil {
+		return err
+	}
+	// Blank lines beyond the first are kept from collapsing like those of
+	// empty paragraphs.
+	for i := 2; i < spacing; i++ {
+		if err := ctx.emit(emptyParagraph); err != nil {
+			return err
+		}
+		if err := ctx.emit("\n\n"); err != nil {
+			return err
+		}
+	}
+	ctx.afterHeading = true
+	return nil
+}
+
+// headingLevel returns the level of a heading element, from 1 for h1 to 6 for
+// h6.
+func headingLevel(node *html.Node) int {
+	switch node.DataAtom {
+	case atom.H1:
+		return 1
+	case atom.H2:
+		return 2
+	case atom.H3:
+		return 3
+	case atom.H4:
+		return 4
+	case atom.H5:
+		return 5
+	}
+	return 6
+}
+
+// headingSlug returns the anchor of a heading: its id, or else a slug of its
+// text made unique among the anchors so far and the ids of the document.
+func (ctx *textifyTraverseContext) headingSlug(node *html.Node) string {
+	ctx.linkCtx.collectIDs(node)
+	if id := strings.TrimSpace(getAttrVal(node, "id")); id != "" {
+		return ctx.linkCtx.explicitAnchor(id)
+	}
+
+	var buf strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(textContent(node)) {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+			if hyphen && buf.Len() > 0 {
+				buf.WriteByte('-')
+			}
+			hyphen = false
+			buf.WriteRune(r)
+		case unicode.IsSpace(r), r == '-', r == '_':
+			hyphen = true
+		}
+	}
+	return ctx.linkCtx.anchor(defaultString(buf.String(), "section"))
+}
+
+// emitLines emits each of lines on its own line, surrounded by open and close.
+func (ctx *textifyTraverseContext) emitLines(lines []string, open, close string) error {
+	for i, line := range lines {
+		if i > 0 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		if err := ctx.emit(open + line + close); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detailsHandler renders the summary of a details element on its own line,
+// marked with an indicator of whether the element is open, followed by the rest
+// of its content.
+func (ctx *textifyTraverseContext) detailsHandler(node *html.Node) error {
+	if err := ctx.emit("\n\n"); err != nil {
+		return err
+	}
+
+	var summary *html.Node
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Summary {
+			summary = c
+			break
+		}
+	}
+
+	if summary != nil {
+		if !ctx.options.TextOnly {
+			indicator := "▸ "
+			if hasAttr(node, "open") {
+				indicator = "▾ "
+			}
+			if err := ctx.emit(indicator); err != nil {
+				return err
+			}
+		}
+		if err := ctx.traverseChildren(summary); err != nil {
+			return err
+		}
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+	}
+
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c == summary {
+			continue
+		}
+		if err := ctx.traverse(c); err != nil {
+			return err
+		}
+	}
+
+	return ctx.emit("\n\n")
+}
+
+// listItemHandler renders node children after a list item marker. Items
+// starting with a checkbox are rendered as task list items.
+func (ctx *textifyTraverseContext) listItemHandler(node *html.Node) error {
+	marker := ctx.listCtx.marker(node)
+	if checkbox := taskCheckbox(node); checkbox != nil {
+		// The checkbox itself renders nothing, so it is left in place.
+		if hasAttr(checkbox, "checked") {
+			marker += "[x] "
+		} else {
+			marker += "[ ] "
+		}
+	}
+
+	if !ctx.options.TextOnly {
+		if err := ctx.emitListMarker(marker); err != nil {
+			return err
+		}
+		// Block content starting the item starts on the marker line.
+		ctx.afterListMarker = true
+	}
+
+	// Align wrapped lines and the lines of further blocks with the item text
+	// rather than the marker.
+	indent := ctx.lineWrapper.indent
+	defer func() { ctx.lineWrapper.indent = indent }()
+	if !ctx.options.TextOnly {
+		ctx.lineWrapper.indent = indent + stringWidth(marker)
+	}
+
+	if err := ctx.traverseChildren(node); err != nil {
+		return err
+	}
+
+	ctx.afterListMarker = false
+	return ctx.emit("\n")
+}
+
+// emitListMarker emits the marker of a list item, leaving any ShowLang markers
+// to be emitted along with the item text.
+func (ctx *textifyTraverseContext) emitListMarker(marker string) error {
+	lang := ctx.pendingLang
+	ctx.pendingLang = ""
+	err := ctx.emit(marker)
+	ctx.pendingLang = lang
+	return err
+}
+
+// linkHandler renders the link text followed by the link href.
+func (ctx *textifyTraverseContext) linkHandler(node *html.Node) error {
+	if hasBlockChild(node) {
+		return ctx.blockLinkHandler(node)
+	}
+	if ctx.options.ReferenceLinks && !ctx.options.TextOnly {
+		return ctx.referenceLinkHandler(node)
+	}
+
+	href := ctx.linkHref(node)
+	if ctx.options.LinkPlacement == LinkBeforeText {
+		if err := ctx.emitLinkHref(node, href); err != nil {
+			return err
+		}
+		return ctx.linkContent(node)
+	}
+
+	if err := ctx.linkContent(node); err != nil {
+		return err
+	}
+	return ctx.emitLinkHref(node, href)
+}
+
+// blockLinkHandler renders a link wrapping block content as a block, with the
+// href placed on the first line of the content with LinkBeforeText, and at the
+// end of its last line otherwise, rather than after the blank line ending it.
+// With ReferenceLinks, the reference number is placed at the end instead.
+func (ctx *textifyTraverseContext) blockLinkHandler(node *html.Node) error {
+	href := ctx.linkHref(node)
+	reference := ctx.options.ReferenceLinks && !ctx.options.TextOnly
+
+	subCtx := ctx.sub()
+	if err := subCtx.linkContent(node); err != nil {
+		return err
+	}
+	content := strings.Trim(subCtx.buf.String(), "\n")
+
+	if err := ctx.emit("\n\n"); err != nil {
+		return err
+	}
+	if ctx.options.LinkPlacement == LinkBeforeText && !reference {
+		if err := ctx.emitLinkHref(node, href); err != nil {
+			return err
+		}
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+	}
+	// The content is already wrapped, so it is written as is.
+	if ctx.tableLevel > 0 {
+		ctx.buf.WriteString(content)
+	} else if content != "" {
+		ctx.lineWrapper.writeBlock(content)
+		ctx.afterHeading = false
+	}
+	switch {
+	case reference:
+		if href != "" {
+			n := ctx.linkCtx.reference(href)
+			if err := ctx.emit(" [" + strconv.Itoa(n) + "]"); err != nil {
+				return err
+			}
+		}
+	case ctx.options.LinkPlacement != LinkBeforeText:
+		if err := ctx.emitLinkHref(node, href); err != nil {
+			return err
+		}
+	}
+	// Like a paragraph, a link making up a whole list item keeps it compact.
+	if li := node.Parent; li != nil && li.DataAtom == atom.Li &&
+		firstElementChild(li) == node && lastElementChild(li) == node {
+		return nil
+	}
+	return ctx.emit("\n\n")
+}
+
+// emitLinkHref emits the href of a link at its LinkPlacement, unless it is
+// omitted. It is called before the link text with LinkBeforeText, and after it
+// otherwise. The href is always separated from the link text by a single space,
+// and whitespace at the edge of the link text it is placed at is kept on its
+// other side, so that it stays separated from the text around the link.
+func (ctx *textifyTraverseContext) emitLinkHref(node *html.Node, attrVal string) error {
+	hrefLink := ctx.linkHrefText(node, attrVal)
+	if hrefLink == "" {
+		return nil
+	}
+
+	content := textContent(node)
+	switch ctx.options.LinkPlacement {
+	case LinkBeforeText:
+		if r, _ := utf8.DecodeRuneInString(content); unicode.IsSpace(r) {
+			hrefLink = " " + hrefLink
+		}
+		return ctx.emit(hrefLink + " ")
+	case LinkOnSeparateLine:
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+		if err := ctx.emit(hrefLink); err != nil {
+			return err
+		}
+		return ctx.emit("\n")
+	}
+	if r, _ := utf8.DecodeLastRuneInString(content); unicode.IsSpace(r) {
+		hrefLink += " "
+	}
+	return ctx.emit(" " + hrefLink)
+}
+
+// linkHrefText returns the href of a link formatted to be emitted, or an empty
+// string if it is omitted. An href is omitted if it matches one of the last
+// LinkDedupWindow links, and marked where it may wrap with WrapURLs.
+func (ctx *textifyTraverseContext) linkHrefText(node *html.Node, attrVal string) string {
+	linkText := ""
+	// For simple link element content with single text node only, peek at the link text.
+	if node.FirstChild != nil && node.FirstChild.NextSibling == nil && node.FirstChild.Type == html.TextNode {
+		linkText = node.FirstChild.Data
+	}
+
+	hrefLink := ""
+	if attrVal != "" {
+		href := attrVal
+		if ctx.options.WrapURLs && ctx.tableLevel == 0 {
+			href = urlBreaks(href)
+		}
+		// Don't print link href if it matches link element content or a
+		// link that was just printed.
+		if (!ctx.options.OmitLinks && linkText != attrVal) || !ctx.options.TextOnly {
+			if ctx.options.ANSIColors {
+				hrefLink = "(" + ansiUnderline + href + ansiNotUnderlined + ")"
+			} else {
+				hrefLink = "(" + href + ")"
+			}
+		}
+		if ctx.linkCtx.seen(attrVal, ctx.options.LinkDedupWindow) {
+			hrefLink = ""
+		}
+	}
+	return hrefLink
+}
+
+// urlBreaks marks the places in href where it may be wrapped, which are after
+// each separator of its path and query other than the slashes of "//".
+func urlBreaks(href string) string {
+	var buf strings.Builder
+	for i := 0; i < len(href); i++ {
+		buf.WriteByte(href[i])
+		switch href[i] {
+		case '/':
+			if i+1 < len(href) && href[i+1] == '/' || i > 0 && href[i-1] == '/' {
+				continue
+			}
+		case '?', '&':
+		default:
+			continue
+		}
+		if i+1 < len(href) {
+			buf.WriteString(urlBreak)
+		}
+	}
+	return buf.String()
+}
+
+// referenceLinkHandler renders a link as a Markdown reference-style link,
+// [text][n], whose href is listed with the other references at the end of the
+// document.
+func (ctx *textifyTraverseContext) referenceLinkHandler(node *html.Node) error {
+	href := ctx.linkHref(node)
+	if href == "" {
+		return ctx.linkContent(node)
+	}
+
+	subCtx := ctx.sub()
+	if err := subCtx.linkContent(node); err != nil {
+		return err
+	}
+	n := ctx.linkCtx.reference(href)
+	lead, trail := ctx.inlineSpace(node)
+	return ctx.emit(lead + "[" + subCtx.buf.String() + "][" + strconv.Itoa(n) + "]" + trail)
+}
+
+// linkContent renders the link text, truncated to MaxLinkTextLength runes and
+// ended with an ellipsis if set.
+func (ctx *textifyTraverseContext) linkContent(node *html.Node) error {
+	maxLength := ctx.options.MaxLinkTextLength
+	if maxLength <= 0 {
+		return ctx.fullLinkContent(node)
+	}
+
+	plain := textContent(node)
+	if img := node.FirstChild; img != nil && node.LastChild == img && img.DataAtom == atom.Img {
+		plain = ctx.imageText(img)
+	}
+	runes := []rune(strings.Join(strings.Fields(plain), " "))
+	if len(runes) <= maxLength {
+		return ctx.fullLinkContent(node)
+	}
+
+	// The text is truncated without markup, which could otherwise be cut off
+	// unbalanced.
+	text := strings.TrimRightFunc(string(runes[:maxLength]), unicode.IsSpace) + ellipsis
+	lead, trail := ctx.inlineSpace(node)
+	return ctx.emit(lead + ctx.transformText(text) + trail)
+}
+
+// fullLinkContent renders the link text. If an image is the only child, its
+// alt text is the link text.
+func (ctx *textifyTraverseContext) fullLinkContent(node *html.Node) error {
+	if img := node.FirstChild; img != nil && node.LastChild == img && img.DataAtom == atom.Img {
+		if altText := ctx.imageText(img); altText != "" {
+			return ctx.emit(altText)
+		}
+		return nil
+	}
+	return ctx.traverseChildren(node)
+}
+
+// linkHref returns the normalized href of a link, or an empty string if there
+// is no link to print. Name-only anchors and blank hrefs have no link to print,
+// nor do data: URIs unless KeepDataURIImages is set.
+func (ctx *textifyTraverseContext) linkHref(node *html.Node) string {
+	href := getAttrVal(node, "href")
+	if !ctx.isAllowedLinkScheme(href) {
+		ctx.warn(node, "dropped link with disallowed scheme: %s", href)
+		return ""
+	}
+	if isDataURI(href) && !ctx.options.KeepDataURIImages {
+		ctx.warn(node, "dropped data: URI link")
+		return ""
+	}
+	return ctx.normalizeHrefLink(href)
+}
+
+// imageHandler renders the alt text and source of an image when
+// IncludeImageURLs is set. A data: URI source is dropped unless
+// KeepDataURIImages is set.
+func (ctx *textifyTraverseContext) imageHandler(node *html.Node) error {
+	if !ctx.options.IncludeImageURLs {
+		return nil
+	}
+
+	if err := ctx.emit(ctx.imageText(node)); err != nil {
+		return err
+	}
+
+	src := strings.TrimSpace(getAttrVal(node, "src"))
+	if src == "" {
+		return nil
+	}
+	if isDataURI(src) && !ctx.options.KeepDataURIImages {
+		ctx.warn(node, "dropped data: URI image source")
+		return nil
+	}
+	return ctx.emit(" (" + src + ")")
+}
+
+// imageText returns the alt text of img formatted with ImagePlaceholder, in
+// which "{alt}" is replaced by it, or an empty string if img has no alt text.
+func (ctx *textifyTraverseContext) imageText(img *html.Node) string {
+	alt := getAttrVal(img, "alt")
+	if alt == "" || ctx.options.ImagePlaceholder == "" {
+		return alt
+	}
+	return strings.ReplaceAll(ctx.options.ImagePlaceholder, "{alt}", alt)
+}
+
+// emphasisHandler renders node children surrounded by the markers for the kind
+// of emphasis. Unless KeepNestedEmphasis is set, markers are not repeated for
+// emphasis nested within the same kind of emphasis.
+func (ctx *textifyTraverseContext) emphasisHandler(node *html.Node, kind emphasis) error {
+	if ctx.emphasis&kind != 0 && !ctx.options.KeepNestedEmphasis {
+		return ctx.traverseChildren(node)
+	}
+	if ctx.inEmphasisRun(node) {
+		return nil
+	}
+
+	subCtx := ctx.sub()
+	subCtx.endsWithSpace = true
+	subCtx.emphasis |= kind
+	if err := subCtx.traverseChildren(node); err != nil {
+		return err
+	}
+
+	last := node
+	if ctx.options.MergeAdjacentEmphasis {
+		// Render the following siblings of the same kind of emphasis, and
+		// the whitespace between them, within the same markers.
+		for c := node.NextSibling; c != nil && ctx.inEmphasisRun(c); c = c.NextSibling {
+			if c.Type == html.TextNode {
+				if err := subCtx.traverse(c); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := subCtx.traverseChildren(c); err != nil {
+				return err
+			}
+			last = c
+		}
+	}
+
+	str := subCtx.buf.String()
+	lead, _ := ctx.inlineSpace(node)
+	_, trail := ctx.inlineSpace(last)
+	if ctx.options.TextOnly {
+		return ctx.emit(lead + str + trail)
+	}
+	open, close := ctx.emphasisMarkers(kind)
+	return ctx.emit(lead + open + str + close + trail)
+}
+
+// emphasisMarkers returns the markers surrounding emphasis of the given kind,
+// which are BoldDelimiter or "*" for bold and EmphasisDelimiter or "_" for
+// italics unless ANSIColors is set.
+func (ctx *textifyTraverseContext) emphasisMarkers(kind emphasis) (open, close string) {
+	if ctx.options.ANSIColors {
+		if kind == emphasisBold {
+			return ansiBold, ansiNormalIntensity
+		}
+		return ansiItalic, ansiNotItalic
+	}
+
+	if kind == emphasisBold {
+		marker := defaultString(ctx.options.BoldDelimiter, "*")
+		return marker, marker
+	}
+	marker := defaultString(ctx.options.EmphasisDelimiter, "_")
+	return marker, marker
+}
+
+// inEmphasisRun reports whether node continues a run of adjacent bold or italic
+// elements of the same kind, separated by whitespace at most, that is rendered
+// as one by MergeAdjacentEmphasis.
+func (ctx *textifyTraverseContext) inEmphasisRun(node *html.Node) bool {
+	if !ctx.options.MergeAdjacentEmphasis {
+		return false
+	}
+
+	if node.Type == html.TextNode {
+		if strings.TrimSpace(node.Data) != "" || node.PrevSibling == nil || node.NextSibling == nil {
+			return false
+		}
+		kind := ctx.runEmphasis(node.PrevSibling)
+		return kind != 0 && ctx.runEmphasis(node.NextSibling) == kind && ctx.emphasis&kind == 0
+	}
+
+	kind := ctx.runEmphasis(node)
+	if kind == 0 || ctx.emphasis&kind != 0 {
+		return false
+	}
+	prev := node.PrevSibling
+	if prev != nil && prev.Type == html.TextNode && strings.TrimSpace(prev.Data) == "" {
+		prev = prev.PrevSibling
+	}
+	return prev != nil && ctx.runEmphasis(prev) == kind
+}
+
+// runEmphasis returns the kind of emphasis that node contributes to a run of
+// adjacent emphasis, which is zero for elements that are skipped rather than
+// rendered.
+func (ctx *textifyTraverseContext) runEmphasis(node *html.Node) emphasis {
+	if ctx.skipsElement(node) {
+		return 0
+	}
+	return elementEmphasis(node)
+}
+
+// skipsElement reports whether the element node is skipped along with its
+// content, as aria-hidden elements are with SkipAriaHidden.
+func (ctx *textifyTraverseContext) skipsElement(node *html.Node) bool {
+	return node.Type == html.ElementNode && ctx.options.SkipAriaHidden && isAriaHidden(node)
+}
+
+// elementEmphasis returns the kind of emphasis of a bold or italic element, or
+// zero for any other node.
+func elementEmphasis(node *html.Node) emphasis {
+	if node.Type != html.ElementNode {
+		return 0
+	}
+	switch node.DataAtom {
+	case atom.B, atom.Strong:
+		return emphasisBold
+	case atom.Em, atom.I:
+		return emphasisItalic
+	}
+	return 0
+}
+
+// preChildrenHandler renders the children of the pre element node, removing
+// their common indentation if PreTrimIndent is set.
+func (ctx *textifyTraverseContext) preChildrenHandler(node *html.Node) error {
+	if !ctx.options.PreTrimIndent {
+		return ctx.traverseChildren(node)
+	}
+
+	subCtx := ctx.sub()
+	if err := subCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	return ctx.emit(dedent(subCtx.buf.String()))
+}
+
+// dedent removes the longest leading whitespace common to all lines of text
+// that aren't blank, preserving their relative indentation.
+func dedent(text string) string {
+	lines := strings.Split(text, "\n")
+
+	var prefix string
+	found := false
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found {
+			prefix, found = indent, true
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if prefix == "" {
+		return text
+	}
+
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[i] = strings.TrimLeft(line, " \t")
+		} else {
+			lines[i] = line[len(prefix):]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// codeBlockHandler renders the preformatted node children between code fences.
+func (ctx *textifyTraverseContext) codeBlockHandler(node *html.Node) error {
+	if err := ctx.emit("\n\n"); err != nil {
+		return err
+	}
+
+	// The fence is longer than any run of backticks in the code, which would
+	// otherwise end the block.
+	fence := "```"
+	if n := longestRun(textContent(node), '`'); n >= len(fence) {
+		fence = strings.Repeat("`", n+1)
+	}
+
+	ctx.isPre = true
+	if err := ctx.emit(fence + codeLanguage(node) + "\n"); err != nil {
+		return err
+	}
+	if err := ctx.preChildrenHandler(node); err != nil {
+		return err
+	}
+	if ctx.tableLevel > 0 || ctx.lineWrapper.n > 0 {
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+	}
+	if err := ctx.emit(fence); err != nil {
+		return err
+	}
+	ctx.isPre = false
+
+	return ctx.emit("\n\n")
+}
+
+// codeLanguage returns the language of the code in the pre element node,
+// declared by a "language-" or "lang-" prefixed class of node or of the code
+// element that is its only child, as used by syntax highlighters, or an empty
+// string if none is declared.
+func codeLanguage(node *html.Node) string {
+	elements := []*html.Node{node}
+	if code := firstElementChild(node); code != nil && code.DataAtom == atom.Code && lastElementChild(node) == code {
+		elements = append(elements, code)
+	}
+
+	for _, e := range elements {
+		for _, class := range strings.Fields(getAttrVal(e, "class")) {
+			for _, prefix := range []string{"language-", "lang-"} {
+				if strings.HasPrefix(class, prefix) && len(class) > len(prefix) {
+					return class[len(prefix):]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// inlineCodeHandler renders node children as inline code, between backticks
+// that outnumber any run of backticks within it. The code is padded with spaces
+// if it starts or ends with a backtick, keeping it apart from the fence.
+func (ctx *textifyTraverseContext) inlineCodeHandler(node *html.Node) error {
+	subCtx := ctx.sub()
+	if err := subCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	code := subCtx.buf.String()
+	fence := strings.Repeat("`", longestRun(code, '`')+1)
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+		code = " " + code + " "
+	}
+	lead, trail := ctx.inlineSpace(node)
+	return ctx.emit(lead + fence + code + fence + trail)
+}
+
+// longestRun returns the length of the longest run of c in s.
+func longestRun(s string, c byte) int {
+	longest, n := 0, 0
+	for i := 0; i < len(s); i++ {
+		if s[i] != c {
+			n = 0
+			continue
+		}
+		n++
+		if n > longest {
+			longest = n
+		}
+	}
+	return longest
+}
+
+// wrapHandler renders node children inline between open and close.
+func (ctx *textifyTraverseContext) wrapHandler(node *html.Node, open, close string) error {
+	subCtx := ctx.sub()
+	if err := subCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	lead, trail := ctx.inlineSpace(node)
+	return ctx.emit(lead + open + subCtx.buf.String() + close + trail)
+}
+
+// plainTableHandler renders the content of a table that isn't collected
+// surrounded by double newlines. As in collected tables, footers are rendered
+// last regardless of where they appear.
+func (ctx *textifyTraverseContext) plainTableHandler(node *html.Node) error {
+	if ctx.options.StrictTables || ctx.warnings != nil {
+		if err := ctx.checkTableRows(node); err != nil {
+			return err
+		}
+	}
+	if err := ctx.emit("\n\n"); err != nil {
+		return err
+	}
+	for _, footers := range []bool{false, true} {
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			if isFooter := c.Type == html.ElementNode && c.DataAtom == atom.Tfoot; isFooter != footers {
+				continue
+			}
+			if err := ctx.traverse(c); err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.emit("\n\n")
+}
+
+// checkTableRows checks that the rows of a table that isn't collected span the
+// same number of columns, as collected tables are checked while rendered.
+func (ctx *textifyTraverseContext) checkTableRows(node *html.Node) error {
+	var tableCtx tableTraverseContext
+	tableCtx.init(*ctx.tableCount)
+	for _, row := range tableRows(node) {
+		if countChildElements(row, atom.Td)+countChildElements(row, atom.Th) == 0 {
+			tableCtx.rowColumns(row)
+			continue
+		}
+		if err := tableCtx.checkRow(row); err != nil {
+			if ctx.options.StrictTables {
+				return err
+			}
+			ctx.warn(row, "%v", err)
+		}
+	}
+	return nil
+}
+
+// tableRows returns the rows of table, including those within its header,
+// body and footer sections, in document order.
+func tableRows(table *html.Node) []*html.Node {
+	var rows []*html.Node
+	for c := table.FirstChild; c != nil; c = c.NextSibling {
+		switch c.DataAtom {
+		case atom.Tr:
+			rows = append(rows, c)
+		case atom.Thead, atom.Tbody, atom.Tfoot:
+			for r := c.FirstChild; r != nil; r = r.NextSibling {
+				if r.DataAtom == atom.Tr {
+					rows = append(rows, r)
+				}
+			}
+		}
+	}
+	return rows
+}
+
+// paragraphHandler renders node children surrounded by double newlines. With
+// NumberParagraphs, non-empty p elements are prefixed with their number, such
+// as "[¶1]".
+func (ctx *textifyTraverseContext) paragraphHandler(node *html.Node) error {
+	if err := ctx.emit("\n\n"); err != nil {
+		return err
+	}
+	if ctx.options.NumberParagraphs && node.DataAtom == atom.P && !isEmptyParagraph(node) {
+		*ctx.paragraphCount++
+		if err := ctx.emit("[¶" + strconv.Itoa(*ctx.paragraphCount) + "] "); err != nil {
+			return err
+		}
+	}
+	if err := ctx.traverseChildren(node); err != nil {
+		return err
+	}
+	// A paragraph making up a whole list item is only followed by the line
+	// break that ends the item, keeping lists of such items compact.
+	if li := node.Parent; node.DataAtom == atom.P && li != nil && li.DataAtom == atom.Li &&
+		firstElementChild(li) == node && lastElementChild(li) == node {
+		return nil
+	}
+	return ctx.emit("\n\n")
+}
+
+// emitTablePreamble emits the separator and label configured to precede a
+// table. The TableSeparator is put on its own line between a table and a table
+// right before it, and NumberTables labels the table "Table N".
+func (ctx *textifyTraverseContext) emitTablePreamble(node *html.Node) error {
+	*ctx.tableCount++
+
+	if ctx.options.TableSeparator != "" {
+		if prev := prevElementSibling(node); prev != nil && prev.DataAtom == atom.Table {
+			if err := ctx.emit("\n\n"); err != nil {
+				return err
+			}
+			if err := ctx.emit(ctx.options.TableSeparator); err != nil {
+				return err
+			}
+		}
+	}
+
+	if ctx.options.NumberTables {
+		if err := ctx.emit("\n\n"); err != nil {
+			return err
+		}
+		if err := ctx.emit("Table " + strconv.Itoa(*ctx.tableCount)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectsTables reports whether tables are collected into tableCtx to be
+// rendered as a whole by handleTableElement.
+func (ctx *textifyTraverseContext) collectsTables() bool {
+	return ctx.options.PrettyTables || ctx.options.PlainTableColumnPadding != nil || ctx.options.TablesAsKeyValue ||
+		ctx.options.TablesAsCSV
+}
+
+// handleTableElement is only to be invoked when collectsTables is true.
+func (ctx *textifyTraverseContext) handleTableElement(node *html.Node) error {
+	if !ctx.collectsTables() {
+		panic("handleTableElement invoked when tables are not collected")
+	}
+
+	switch node.DataAtom {
+	case atom.Table:
+		if err := ctx.emit("\n\n"); err != nil {
+			return err
+		}
+
+		// Re-intialize all table context.
+		ctx.tableCtx.init(*ctx.tableCount)
+
+		// Browse children, enriching context with table data.
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+
+		var rendered string
+		if rows := ctx.tableCtx.allRows(); ctx.options.TablesAsCSV {
+			rendered = ctx.renderCSVTable(rows)
+		} else if ctx.options.TablesAsKeyValue && isKeyValueTable(rows) {
+			rendered = renderKeyValueTable(rows)
+		} else if ctx.options.PrettyTables {
+			rendered = ctx.renderPrettyTable()
+		} else {
+			rendered = ctx.renderPlainTable()
+		}
+
+		ctx.lineWrapper.flush()
+		start := ctx.buf.Len()
+		if err := ctx.emit(rendered); err != nil {
+			return err
+		}
+		ctx.tableSpans = append(ctx.tableSpans, [2]int{start, ctx.buf.Len()})
+
+		return ctx.emit("\n\n")
+
+	case atom.Thead:
+		ctx.tableCtx.isInHeader = true
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		ctx.tableCtx.isInHeader = false
+
+	case atom.Tbody:
+		return ctx.traverseChildren(node)
+
+	case atom.Colgroup:
+		ctx.tableCtx.addColumns(node)
+
+	case atom.Tfoot:
+		ctx.tableCtx.isInFooter = true
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		ctx.tableCtx.isInFooter = false
+
+	case atom.Tr:
+		if countChildElements(node, atom.Td)+countChildElements(node, atom.Th) == 0 {
+			// An empty row has nothing to render, though it still ends the
+			// rows of cells spanning down into it.
+			ctx.tableCtx.rowColumns(node)
+			return nil
+		}
+
+		if ctx.options.StrictTables || ctx.warnings != nil {
+			if err := ctx.tableCtx.checkRow(node); err != nil {
+				if ctx.options.StrictTables {
+					return err
+				}
+				ctx.warn(node, "%v", err)
+			}
+		}
+
+		ctx.tableCtx.body = append(ctx.tableCtx.body, []string{})
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		ctx.tableCtx.tmpRow++
+
+	case atom.Th, atom.Td:
+		res, err := ctx.renderEachChild(node)
+		if err != nil {
+			return err
+		}
+
+		// Row headers start their row rather than labelling a column.
+		isColumnHeader := node.DataAtom == atom.Th && !isRowHeader(node)
+		if isColumnHeader || ctx.tableCtx.isInHeader {
+			ctx.tableCtx.header = append(ctx.tableCtx.header, res)
+		} else if ctx.tableCtx.isInFooter {
+			ctx.tableCtx.footer = append(ctx.tableCtx.footer, res)
+		} else {
+			ctx.tableCtx.body[ctx.tableCtx.tmpRow] = append(ctx.tableCtx.body[ctx.tableCtx.tmpRow], res)
+		}
+
+	}
+	return nil
+}
+
+// renderPrettyTable renders the collected table using ASCII borders.
+func (ctx *textifyTraverseContext) renderPrettyTable() string {
+	buf := &bytes.Buffer{}
+	table := tablewriter.NewWriter(buf)
+	if ctx.options.PrettyTablesOptions != nil {
+		options := ctx.options.PrettyTablesOptions
+		table.SetAutoFormatHeaders(options.AutoFormatHeader)
+		table.SetAutoWrapText(options.AutoWrapText)
+		table.SetReflowDuringAutoWrap(options.ReflowDuringAutoWrap)
+		table.SetColWidth(options.ColWidth)
+		table.SetColumnSeparator(options.ColumnSeparator)
+		table.SetRowSeparator(options.RowSeparator)
+		table.SetCenterSeparator(options.CenterSeparator)
+		table.SetHeaderAlignment(options.HeaderAlignment)
+		table.SetFooterAlignment(options.FooterAlignment)
+		table.SetAlignment(options.Alignment)
+		if len(ctx.tableCtx.columnAlign) == 0 {
+			table.SetColumnAlignment(options.ColumnAlignment)
+		}
+		table.SetNewLine(options.NewLine)
+		table.SetHeaderLine(options.HeaderLine)
+		table.SetRowLine(options.RowLine)
+		table.SetAutoMergeCells(options.AutoMergeCells)
+		table.SetBorders(options.Borders)
+	}
+	if len(ctx.tableCtx.columnAlign) > 0 {
+		table.SetColumnAlignment(ctx.prettyColumnAlignment())
+	}
+	// The header and footer are padded to the width of the table, as
+	// tablewriter expects them to span all of its columns.
+	columns := ctx.tableCtx.columnCount()
+	table.SetHeader(padRow(ctx.tableCtx.header, columns))
+	table.SetFooter(padRow(ctx.tableCtx.footer, columns))
+	table.AppendBulk(ctx.tableCtx.body)
+
+	// Render the table using ASCII.
+	table.Render()
+	return buf.String()
+}
+
+// prettyColumnAlignment returns the alignment of each column of the collected
+// table. Alignment set in PrettyTablesOptions.ColumnAlignment takes precedence
+// over that declared by col elements, which takes precedence over
+// PrettyTablesOptions.Alignment.
+func (ctx *textifyTraverseContext) prettyColumnAlignment() []int {
+	columns := ctx.tableCtx.columnCount()
+
+	def := tablewriter.ALIGN_DEFAULT
+	var preferred []int
+	if options := ctx.options.PrettyTablesOptions; options != nil {
+		def = options.Alignment
+		preferred = options.ColumnAlignment
+	}
+
+	declared := ctx.tableCtx.columnAlign
+	align := make([]int, columns)
+	for i := range align {
+		switch {
+		case i < len(preferred) && preferred[i] != tablewriter.ALIGN_DEFAULT:
+			align[i] = preferred[i]
+		case i < len(declared) && declared[i] != tablewriter.ALIGN_DEFAULT:
+			align[i] = declared[i]
+		default:
+			align[i] = def
+		}
+	}
+	return align
+}
+
+// renderPlainTable renders the collected table as columns padded to line up,
+// as configured by PlainTableColumnPadding.
+func (ctx *textifyTraverseContext) renderPlainTable() string {
+	padding := ctx.options.PlainTableColumnPadding
+	if padding == nil {
+		padding = &PlainTableColumnPadding{}
+	}
+
+	rows := ctx.tableCtx.allRows()
+
+	var widths []int
+	for _, row := range rows {
+		for i, cell := range row {
+			// Cells are laid out on a single line.
+			row[i] = strings.Join(strings.Fields(cell), " ")
+			if i == len(widths) {
+				widths = append(widths, padding.MinWidth)
+			}
+			if w := stringWidth(row[i]); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+
+	padChar := " "
+	if padding.Padding != 0 {
+		padChar = string(padding.Padding)
+	}
+	separator := defaultString(padding.Separator, "  ")
+
+	var buf strings.Builder
+	for _, row := range rows {
+		for i, cell := range row {
+			buf.WriteString(cell)
+			if i < len(row)-1 {
+				buf.WriteString(strings.Repeat(padChar, widths[i]-stringWidth(cell)))
+				buf.WriteString(separator)
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// renderCSVTable renders the rows of a table as CSV records quoted as in RFC
+// 4180, with fields separated by CSVSeparator or ','.
+func (ctx *textifyTraverseContext) renderCSVTable(rows [][]string) string {
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
+	if ctx.options.CSVSeparator != 0 {
+		w.Comma = ctx.options.CSVSeparator
+	}
+	// Writing to a strings.Builder can't fail, and Validate rejects invalid
+	// separators.
+	w.WriteAll(rows)
+	return buf.String()
+}
+
+// isKeyValueTable reports whether every row of a table has exactly two cells,
+// a label and its value.
+func isKeyValueTable(rows [][]string) bool {
+	for _, row := range rows {
+		if len(row) != 2 {
+			return false
+		}
+	}
+	return len(rows) > 0
+}
+
+// renderKeyValueTable renders the rows of a two-column table as "Label: Value"
+// lines.
+func renderKeyValueTable(rows [][]string) string {
+	var buf strings.Builder
+	for _, row := range rows {
+		buf.WriteString(strings.Join(strings.Fields(row[0]), " "))
+		buf.WriteString(": ")
+		buf.WriteString(strings.Join(strings.Fields(row[1]), " "))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+func (ctx *textifyTraverseContext) traverse(node *html.Node) error {
+	if ctx.options.MaxDepth > 0 && ctx.depth >= ctx.options.MaxDepth {
+		return ErrMaxDepth
+	}
+	ctx.depth++
+	defer func() { ctx.depth-- }()
+
+	switch node.Type {
+	default:
+		return ctx.traverseChildren(node)
+
+	case html.TextNode:
+		if ctx.inEmphasisRun(node) {
+			// Already rendered along with the run of emphasis around it.
+			ctx.trace(node, TraceSkip)
+			return nil
+		}
+		ctx.trace(node, TraceEmit)
+		return ctx.emit(ctx.textData(node))
+
+	case html.CommentNode:
+		if !ctx.options.KeepComments {
+			ctx.trace(node, TraceSkip)
+			return nil
+		}
+		// Kept comments are annotated to set them apart from the text.
+		ctx.trace(node, TraceEmit)
+		comment := strings.Join(strings.Fields(node.Data), " ")
+		if comment == "" {
+			return nil
+		}
+		return ctx.emit(" [comment: " + comment + "] ")
+
+	case html.ElementNode:
+		ctx.trace(node, TraceEnter)
+		return ctx.handleElement(node)
+	}
+}
+
+func (ctx *textifyTraverseContext) traverseChildren(node *html.Node) error {
+	// Emphasis declared in an inline style surrounds the children of any
+	// element with inline content. Elements with block content, and those
+	// whose children share state with them, pass it on to the inline content
+	// within them instead.
+	kind := ctx.blockEmphasis
+	if ctx.isPre {
+		kind = 0
+	}
+	if node.Type == html.ElementNode {
+		kind |= styleEmphasis(node)
+	}
+	kind &^= ctx.emphasis
+
+	sharesState := false
+	switch node.DataAtom {
+	case atom.Ul, atom.Ol, atom.Table, atom.Thead, atom.Tbody, atom.Tfoot, atom.Tr:
+		sharesState = true
+	}
+
+	if kind != 0 && !sharesState && !hasBlockChild(node) {
+		if kind&emphasisBold != 0 {
+			return ctx.emphasisHandler(node, emphasisBold)
+		}
+		return ctx.emphasisHandler(node, emphasisItalic)
+	}
+
+	blockEmphasis := ctx.blockEmphasis
+	defer func() { ctx.blockEmphasis = blockEmphasis }()
+	ctx.blockEmphasis |= kind
+
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if kind != 0 && !sharesState && !isBlockNode(c) {
+			// Wrap the run of inline content starting at c.
+			last := c
+			for last.NextSibling != nil && !isBlockNode(last.NextSibling) {
+				last = last.NextSibling
+			}
+			if err := ctx.emphasisRunHandler(c, last, kind); err != nil {
+				return err
+			}
+			c = last
+			continue
+		}
+		if err := ctx.traverse(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// emphasisRunHandler renders the sibling nodes from first to last surrounded by
+// the markers for the kinds of emphasis, such as the text between the blocks
+// of an element with emphasis declared in its style.
+func (ctx *textifyTraverseContext) emphasisRunHandler(first, last *html.Node, kind emphasis) error {
+	subCtx := ctx.sub()
+	subCtx.endsWithSpace = true
+	subCtx.emphasis |= kind
+	var raw strings.Builder
+	for c := first; ; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			raw.WriteString(c.Data)
+		} else {
+			raw.WriteString(textContent(c))
+		}
+		if err := subCtx.traverse(c); err != nil {
+			return err
+		}
+		if c == last {
+			break
+		}
+	}
+
+	str := subCtx.buf.String()
+	lead, trail := ctx.surroundingSpace(raw.String())
+	if strings.TrimSpace(str) == "" || ctx.options.TextOnly {
+		return ctx.emit(lead + str + trail)
+	}
+
+	var open, close string
+	if kind&emphasisBold != 0 {
+		open, close = ctx.emphasisMarkers(emphasisBold)
+	}
+	if kind&emphasisItalic != 0 {
+		italicOpen, italicClose := ctx.emphasisMarkers(emphasisItalic)
+		open, close = open+italicOpen, italicClose+close
+	}
+	return ctx.emit(lead + open + str + close + trail)
+}
+
+func (ctx *textifyTraverseContext) emit(data string) error {
+	// Any content emitted after a div has closed ends its trailing newline.
+	if strings.Trim(data, "\n") != "" {
+		ctx.justClosedDiv = false
+		ctx.afterListMarker = false
+		ctx.afterHeading = false
+		if ctx.pendingLang != "" {
+			text := strings.TrimLeftFunc(data, unicode.IsSpace)
+			data = data[:len(data)-len(text)] + ctx.pendingLang + text
+			ctx.pendingLang = ""
+		}
+	} else if ctx.afterListMarker || ctx.afterHeading {
+		return nil
+	}
+
+	if ctx.tableLevel > 0 {
+		ctx.lineWrapper.flush()
+		ctx.buf.WriteString(data)
+		return nil
+	}
+
+	if data == "" {
+		return nil
+	}
+
+	if ctx.isPre {
+		ctx.lineWrapper.writePre(data)
+		return nil
+	}
+
+	if strings.Trim(data, "\n") == "" {
+		ctx.lineWrapper.flushN(len(data))
+		return nil
+	}
+
+	ctx.lineWrapper.write(data)
+	return nil
+}
+
+// warn records a warning about node if warnings are being collected.
+func (ctx *textifyTraverseContext) warn(node *html.Node, format string, args ...interface{}) {
+	if ctx.warnings != nil {
+		*ctx.warnings = append(*ctx.warnings, Warning{Node: node, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// trace reports an action taken on node to the Trace option, if any.
+func (ctx *textifyTraverseContext) trace(node *html.Node, action string) {
+	if ctx.options.Trace != nil {
+		ctx.options.Trace(node, action)
+	}
+}
+
+// textData returns the text to emit for a text node. Outside of tables, a
+// single space is kept on either side where the node has surrounding
+// whitespace, so that it stays separated from adjacent inline content.
+func (ctx *textifyTraverseContext) textData(node *html.Node) string {
+	if ctx.isPre {
+		return ctx.transformText(node.Data)
+	}
+
+	data := ctx.transformText(ctx.trimSpace(node.Data))
+	if ctx.tableLevel > 0 {
+		return data
+	}
+
+	lead, trail := ctx.surroundingSpace(node.Data)
+	if data == "" && (lead != "" || trail != "") {
+		return " "
+	}
+	return lead + data + trail
+}
+
+// transformText applies the TextTransformer option to non-empty text.
+func (ctx *textifyTraverseContext) transformText(data string) string {
+	if ctx.uppercase {
+		data = strings.ToUpper(data)
+	}
+	if ctx.options.TextTransformer != nil && data != "" {
+		data = ctx.options.TextTransformer(data)
+	}
+	return data
+}
+
+// surroundingSpace returns a space for each side of s that begins or ends
+// with whitespace.
+func (ctx *textifyTraverseContext) surroundingSpace(s string) (lead, trail string) {
+	isSpace := unicode.IsSpace
+	if ctx.options.KeepNBSP {
+		isSpace = isBreakingSpace
+	}
+
+	if r, _ := utf8.DecodeRuneInString(s); isSpace(r) {
+		lead = " "
+	}
+	if r, _ := utf8.DecodeLastRuneInString(s); isSpace(r) {
+		trail = " "
+	}
+	return lead, trail
+}
+
+// inlineSpace returns the whitespace surrounding the text content of node,
+// which is lost when its children are rendered apart from their siblings.
+func (ctx *textifyTraverseContext) inlineSpace(node *html.Node) (lead, trail string) {
+	if ctx.tableLevel > 0 {
+		return "", ""
+	}
+	if first := firstTextDescendant(node); first != nil {
+		lead, _ = ctx.surroundingSpace(first.Data)
+	}
+	if last := lastTextDescendant(node); last != nil {
+		_, trail = ctx.surroundingSpace(last.Data)
+	}
+	return lead, trail
+}
+
+// trimSpace trims the spaces surrounding text node content.
+func (ctx *textifyTraverseContext) trimSpace(s string) string {
+	if ctx.options.KeepNBSP {
+		return strings.TrimFunc(s, isBreakingSpace)
+	}
+	return strings.TrimSpace(s)
+}
+
+// headingBottomSpacing returns the number of newlines ending a heading, which
+// is HeadingBottomSpacing if set and 2 otherwise.
+func (ctx *textifyTraverseContext) headingBottomSpacing() int {
+	if ctx.options.HeadingBottomSpacing > 0 {
+		return ctx.options.HeadingBottomSpacing
+	}
+	return 2
+}
+
+// renderGauge renders a progress or meter element as a bar GaugeWidth or 10
+// characters wide followed by its percentage, or just the percentage in
+// TextOnly mode.
+func (ctx *textifyTraverseContext) renderGauge(node *html.Node) string {
+	value := floatAttrVal(node, "value", 0)
+	min := 0.0
+	if node.DataAtom == atom.Meter {
+		min = floatAttrVal(node, "min", 0)
+	}
+	max := floatAttrVal(node, "max", 100)
+	if max <= min {
+		max = min + 100
+	}
+
+	fraction := (value - min) / (max - min)
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+
+	percent := strconv.Itoa(int(math.Round(fraction*100))) + "%"
+	if ctx.options.TextOnly {
+		return percent
+	}
+
+	width := ctx.options.GaugeWidth
+	if width <= 0 {
+		width = 10
+	}
+	filled := int(math.Round(fraction * float64(width)))
+
+	// The bar is padded with dashes rather than spaces, since spaces would be
+	// collapsed by the line wrapper.
+	return "[" + strings.Repeat("=", filled) + strings.Repeat("-", width-filled) + "] " + percent
+}
+
+// isAllowedLinkScheme reports whether the scheme of link is allowed by
+// LinkSchemeWhitelist. Links without a scheme are always allowed.
+func (ctx *textifyTraverseContext) isAllowedLinkScheme(link string) bool {
+	if ctx.options.LinkSchemeWhitelist == nil {
+		return true
+	}
+
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" {
+		return true
+	}
+
+	for _, scheme := range ctx.options.LinkSchemeWhitelist {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ctx *textifyTraverseContext) normalizeHrefLink(link string) string {
+	link = strings.TrimSpace(link)
+	link = strings.TrimPrefix(link, "mailto:")
+	if ctx.options.StripTrackingParams {
+		link = stripQueryParams(link, ctx.options.TrackingParams)
+	}
+	if ctx.options.URLNormalizer != nil {
+		link = ctx.options.URLNormalizer(link)
+	}
+	return link
+}
+
+// defaultTrackingParams are the query parameters removed by
+// Options.StripTrackingParams unless Options.TrackingParams is set.
+var defaultTrackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "msclkid", "yclid", "igshid", "mc_cid", "mc_eid", "_hsenc", "_hsmi",
+}
+
+// stripQueryParams removes the query parameters matching params from link,
+// keeping the others as they were. A param ending in "*" matches any parameter
+// starting with the rest of it.
+func stripQueryParams(link string, params []string) string {
+	if params == nil {
+		params = defaultTrackingParams
+	}
+
+	u, err := url.Parse(link)
+	if err != nil || u.RawQuery == "" {
+		return link
+	}
+
+	var kept []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		key, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if !matchesParam(key, params) {
+			kept = append(kept, pair)
+		}
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	u.ForceQuery = false
+	return u.String()
+}
+
+// matchesParam reports whether key matches one of params, as described for
+// stripQueryParams.
+func matchesParam(key string, params []string) bool {
+	for _, param := range params {
+		if strings.HasSuffix(param, "*") && strings.HasPrefix(key, strings.TrimSuffix(param, "*")) || key == param {
+			return true
+		}
+	}
+	return false
+}
+
+// renderEachChild visits each direct child of a node and collects the sequence of
+// textuual representaitons separated by a single newline. Children rendering to
+// nothing, such as <br> elements, only contribute their separating newline.
+func (ctx *textifyTraverseContext) renderEachChild(node *html.Node) (string, error) {
+	buf := &bytes.Buffer{}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		s, err := ctx.renderNode(c)
+		if err != nil {
+			return "", err
+		}
+		s = compactLines(s)
+		if s == "" {
+			continue
+		}
+		if buf.Len() > 0 {
+			if err = buf.WriteByte('\n'); err != nil {
+				return "", err
+			}
+		}
+		if _, err = buf.WriteString(s); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// compactLines removes the blank lines separating blocks, such as the summary
+// and content of a details element, so they render as compact cell text.
+func compactLines(s string) string {
+	if !strings.Contains(s, "\n\n") {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	compact := lines[:0]
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			compact = append(compact, line)
 		}
-		return ctx.traverseChildren(node)
+	}
+	return strings.Join(compact, "\n")
+}
 
-	case atom.Pre:
-		ctx.isPre = true
-		err := ctx.traverseChildren(node)
-		ctx.isPre = false
-		return err
+// isDataURI reports whether link is a data: URI, which embeds its content.
+func isDataURI(link string) bool {
+	link = strings.TrimSpace(link)
+	return len(link) >= 5 && strings.EqualFold(link[:5], "data:")
+}
 
-	case atom.Style, atom.Script, atom.Head:
-		// Ignore the subtree.
-		return nil
+// defaultString returns s, or def if s is empty.
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
 
-	default:
-		return ctx.traverseChildren(node)
+func getAttrVal(node *html.Node, attrName string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == attrName {
+			return attr.Val
+		}
 	}
+
+	return ""
 }
 
-// paragraphHandler renders node children surrounded by double newlines.
-func (ctx *textifyTraverseContext) paragraphHandler(node *html.Node) error {
-	if err := ctx.emit("\n\n"); err != nil {
-		return err
+// bidiControls returns the Unicode control characters that surround the
+// content of a bdi or bdo element.
+func bidiControls(node *html.Node) (open, close string) {
+	dir := strings.ToLower(strings.TrimSpace(getAttrVal(node, "dir")))
+
+	if node.DataAtom == atom.Bdo {
+		switch dir {
+		case "rtl":
+			return "\u202E", "\u202C" // RLO ... PDF
+		case "ltr":
+			return "\u202D", "\u202C" // LRO ... PDF
+		}
+		return "", ""
 	}
-	if err := ctx.traverseChildren(node); err != nil {
-		return err
+
+	switch dir {
+	case "rtl":
+		return "\u2067", "\u2069" // RLI ... PDI
+	case "ltr":
+		return "\u2066", "\u2069" // LRI ... PDI
 	}
-	return ctx.emit("\n\n")
+	return "\u2068", "\u2069" // FSI ... PDI
 }
 
-// handleTableElement is only to be invoked when options.PrettyTables is active.
-func (ctx *textifyTraverseContext) handleTableElement(node *html.Node) error {
-	if !ctx.options.PrettyTables {
-		panic("handleTableElement invoked when PrettyTables not active")
+// prevElementSibling returns the closest preceding sibling element of node,
+// skipping over comments and whitespace-only text, or nil if there is other
+// content or no such element.
+func prevElementSibling(node *html.Node) *html.Node {
+	for c := node.PrevSibling; c != nil; c = c.PrevSibling {
+		switch c.Type {
+		case html.ElementNode:
+			return c
+		case html.TextNode:
+			if strings.TrimSpace(c.Data) != "" {
+				return nil
+			}
+		}
 	}
+	return nil
+}
 
-	switch node.DataAtom {
-	case atom.Table:
-		if err := ctx.emit("\n\n"); err != nil {
-			return err
+// hasChildElement reports whether node has a child element of type a.
+func hasChildElement(node *html.Node, a atom.Atom) bool {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == a {
+			return true
 		}
+	}
+	return false
+}
 
-		// Re-intialize all table context.
-		ctx.tableCtx.init()
-
-		// Browse children, enriching context with table data.
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
+// lastElementChild returns the last child element of node, skipping over
+// comments and whitespace-only text, or nil if there is other content last or
+// no such element.
+func lastElementChild(node *html.Node) *html.Node {
+	for c := node.LastChild; c != nil; c = c.PrevSibling {
+		switch c.Type {
+		case html.ElementNode:
+			return c
+		case html.TextNode:
+			if strings.TrimSpace(c.Data) != "" {
+				return nil
+			}
 		}
+	}
+	return nil
+}
 
-		buf := &bytes.Buffer{}
-		table := tablewriter.NewWriter(buf)
-		if ctx.options.PrettyTablesOptions != nil {
-			options := ctx.options.PrettyTablesOptions
-			table.SetAutoFormatHeaders(options.AutoFormatHeader)
-			table.SetAutoWrapText(options.AutoWrapText)
-			table.SetReflowDuringAutoWrap(options.ReflowDuringAutoWrap)
-			table.SetColWidth(options.ColWidth)
-			table.SetColumnSeparator(options.ColumnSeparator)
-			table.SetRowSeparator(options.RowSeparator)
-			table.SetCenterSeparator(options.CenterSeparator)
-			table.SetHeaderAlignment(options.HeaderAlignment)
-			table.SetFooterAlignment(options.FooterAlignment)
-			table.SetAlignment(options.Alignment)
-			table.SetColumnAlignment(options.ColumnAlignment)
-			table.SetNewLine(options.NewLine)
-			table.SetHeaderLine(options.HeaderLine)
-			table.SetRowLine(options.RowLine)
-			table.SetAutoMergeCells(options.AutoMergeCells)
-			table.SetBorders(options.Borders)
+// firstElementChild returns the first child element of node, skipping over
+// comments and whitespace-only text, or nil if there is other content first or
+// no such element.
+func firstElementChild(node *html.Node) *html.Node {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.ElementNode:
+			return c
+		case html.TextNode:
+			if strings.TrimSpace(c.Data) != "" {
+				return nil
+			}
 		}
-		table.SetHeader(ctx.tableCtx.header)
-		table.SetFooter(ctx.tableCtx.footer)
-		table.AppendBulk(ctx.tableCtx.body)
+	}
+	return nil
+}
 
-		// Render the table using ASCII.
-		table.Render()
-		if err := ctx.emit(buf.String()); err != nil {
-			return err
+// isAriaHidden reports whether node is hidden from assistive technologies,
+// which is usually the case for purely decorative content.
+func isAriaHidden(node *html.Node) bool {
+	return strings.EqualFold(strings.TrimSpace(getAttrVal(node, "aria-hidden")), "true")
+}
+
+// inheritedLang returns the language declared by the closest ancestor of node
+// that declares one, or an empty string if there is none.
+func inheritedLang(node *html.Node) string {
+	for p := node.Parent; p != nil; p = p.Parent {
+		if lang := strings.TrimSpace(getAttrVal(p, "lang")); lang != "" {
+			return lang
 		}
+	}
+	return ""
+}
 
-		return ctx.emit("\n\n")
+// langMarker returns the ShowLang marker for node, such as "[fr] ", if it
+// declares a language other than inherited, or an empty string. The html and
+// body elements declare the language of the document and aren't annotated.
+func langMarker(node *html.Node, inherited string) string {
+	if node.DataAtom == atom.Html || node.DataAtom == atom.Body {
+		return ""
+	}
+	lang := strings.TrimSpace(getAttrVal(node, "lang"))
+	if lang == "" || strings.EqualFold(lang, inherited) {
+		return ""
+	}
+	return "[" + lang + "] "
+}
 
-	case atom.Tfoot:
-		ctx.tableCtx.isInFooter = true
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
-		}
-		ctx.tableCtx.isInFooter = false
+// isRowHeader reports whether the table header cell th labels its row, either
+// explicitly through its scope attribute or by sharing its row with data cells.
+func isRowHeader(th *html.Node) bool {
+	switch strings.ToLower(strings.TrimSpace(getAttrVal(th, "scope"))) {
+	case "row":
+		return true
+	case "col":
+		return false
+	}
 
-	case atom.Tr:
-		ctx.tableCtx.body = append(ctx.tableCtx.body, []string{})
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
+	if th.Parent == nil {
+		return false
+	}
+	for c := th.Parent.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Td {
+			return true
 		}
-		ctx.tableCtx.tmpRow++
+	}
+	return false
+}
 
-	case atom.Th:
-		res, err := ctx.renderEachChild(node)
-		if err != nil {
-			return err
+// firstTextDescendant returns the first text node within node, or nil if there
+// is none.
+func firstTextDescendant(node *html.Node) *html.Node {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			return c
 		}
-
-		ctx.tableCtx.header = append(ctx.tableCtx.header, res)
-
-	case atom.Td:
-		res, err := ctx.renderEachChild(node)
-		if err != nil {
-			return err
+		if text := firstTextDescendant(c); text != nil {
+			return text
 		}
+	}
+	return nil
+}
 
-		if ctx.tableCtx.isInFooter {
-			ctx.tableCtx.footer = append(ctx.tableCtx.footer, res)
-		} else {
-			ctx.tableCtx.body[ctx.tableCtx.tmpRow] = append(ctx.tableCtx.body[ctx.tableCtx.tmpRow], res)
+// lastTextDescendant returns the last text node within node, or nil if there
+// is none.
+func lastTextDescendant(node *html.Node) *html.Node {
+	for c := node.LastChild; c != nil; c = c.PrevSibling {
+		if c.Type == html.TextNode {
+			return c
 		}
+		if text := lastTextDescendant(c); text != nil {
+			return text
+		}
+	}
+	return nil
+}
 
+// taskCheckbox returns the checkbox input starting the task list item li, or
+// nil if li is not a task list item.
+func taskCheckbox(li *html.Node) *html.Node {
+	first := firstElementChild(li)
+	if first != nil && first.DataAtom == atom.P {
+		first = firstElementChild(first)
+	}
+	if first != nil && first.DataAtom == atom.Input && strings.EqualFold(getAttrVal(first, "type"), "checkbox") {
+		return first
 	}
 	return nil
 }
 
-func (ctx *textifyTraverseContext) traverse(node *html.Node) error {
-	switch node.Type {
-	default:
-		return ctx.traverseChildren(node)
+// isTaskCheckbox reports whether input is the checkbox of a task list item.
+func isTaskCheckbox(input *html.Node) bool {
+	li := input.Parent
+	if li != nil && li.DataAtom == atom.P {
+		li = li.Parent
+	}
+	return li != nil && li.DataAtom == atom.Li && taskCheckbox(li) == input
+}
 
-	case html.TextNode:
-		var data string
-		if ctx.isPre {
-			data = node.Data
-		} else {
-			data = strings.TrimSpace(node.Data)
-		}
-		return ctx.emit(data)
+// floatAttrVal returns the numeric value of an attribute, or def if it is
+// missing or malformed.
+func floatAttrVal(node *html.Node, attrName string, def float64) float64 {
+	f, err := strconv.ParseFloat(strings.TrimSpace(getAttrVal(node, attrName)), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return def
+	}
+	return f
+}
 
-	case html.ElementNode:
-		return ctx.handleElement(node)
+// styleProperty returns the lowercased value of a property declared in the
+// inline style attribute of node, or an empty string if it isn't declared.
+func styleProperty(node *html.Node, property string) string {
+	style := getAttrVal(node, "style")
+	if style == "" {
+		return ""
+	}
+
+	var value string
+	for _, decl := range strings.Split(style, ";") {
+		name, val, ok := strings.Cut(decl, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), property) {
+			// The last declaration wins, like in CSS.
+			value = strings.ToLower(strings.TrimSpace(val))
+			value = strings.TrimSpace(strings.TrimSuffix(value, "!important"))
+		}
 	}
+	return value
 }
 
-func (ctx *textifyTraverseContext) traverseChildren(node *html.Node) error {
-	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		if err := ctx.traverse(c); err != nil {
-			return err
+// styleEmphasis returns the kinds of emphasis declared in the inline style of
+// node.
+func styleEmphasis(node *html.Node) emphasis {
+	var kind emphasis
+
+	switch weight := styleProperty(node, "font-weight"); weight {
+	case "bold", "bolder":
+		kind |= emphasisBold
+	default:
+		if n, err := strconv.Atoi(weight); err == nil && n >= 700 {
+			kind |= emphasisBold
 		}
 	}
 
-	return nil
+	style := styleProperty(node, "font-style")
+	if style == "italic" || strings.HasPrefix(style, "oblique") {
+		kind |= emphasisItalic
+	}
+
+	return kind
 }
 
-func (ctx *textifyTraverseContext) emit(data string) error {
-	if ctx.tableLevel > 0 {
-		ctx.lineWrapper.flush()
-		ctx.buf.WriteString(data)
-		return nil
+// isPreStyle reports whether the inline style of node preserves whitespace.
+func isPreStyle(node *html.Node) bool {
+	switch styleProperty(node, "white-space") {
+	case "pre", "pre-wrap", "break-spaces":
+		return true
 	}
+	return false
+}
 
-	switch data {
-	case "":
-		return nil
-	case "\n":
-		ctx.lineWrapper.flush()
-		return nil
-	case "\n\n":
-		ctx.lineWrapper.flushN(2)
-		return nil
+// spanAttrVal returns the value of a colspan or rowspan attribute, defaulting
+// to 1 if it is missing or malformed.
+func spanAttrVal(node *html.Node, attrName string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(getAttrVal(node, attrName)))
+	if err != nil || n < 1 {
+		return 1
 	}
-
-	ctx.lineWrapper.write(data)
-	return nil
+	return n
 }
 
-func (ctx *textifyTraverseContext) normalizeHrefLink(link string) string {
-	link = strings.TrimSpace(link)
-	link = strings.TrimPrefix(link, "mailto:")
-	return link
+// isEmptyParagraph reports whether the paragraph p has no content other than
+// whitespace and line breaks.
+func isEmptyParagraph(p *html.Node) bool {
+	for c := p.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.CommentNode:
+		case html.TextNode:
+			if strings.TrimSpace(c.Data) != "" {
+				return false
+			}
+		case html.ElementNode:
+			if c.DataAtom != atom.Br {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
 }
 
-// renderEachChild visits each direct child of a node and collects the sequence of
-// textuual representaitons separated by a single newline.
-func (ctx *textifyTraverseContext) renderEachChild(node *html.Node) (string, error) {
-	buf := &bytes.Buffer{}
+// textContent returns the concatenated content of the text nodes within node.
+func textContent(node *html.Node) string {
+	var buf strings.Builder
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		s, err := FromHTMLNode(c, ctx.options)
-		if err != nil {
-			return "", err
-		}
-		if _, err = buf.WriteString(s); err != nil {
-			return "", err
-		}
-		if c.NextSibling != nil {
-			if err = buf.WriteByte('\n'); err != nil {
-				return "", err
-			}
+		if c.Type == html.TextNode {
+			buf.WriteString(c.Data)
+		} else {
+			buf.WriteString(textContent(c))
 		}
 	}
-	return buf.String(), nil
+	return buf.String()
 }
 
-func getAttrVal(node *html.Node, attrName string) string {
+func hasAttr(node *html.Node, attrName string) bool {
 	for _, attr := range node.Attr {
 		if attr.Key == attrName {
-			return attr.Val
+			return true
 		}
 	}
 
-	return ""
+	return false
+}
+
+// countChildElements counts the direct children of node with the given atom.
+func countChildElements(node *html.Node, a atom.Atom) int {
+	var n int
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == a {
+			n++
+		}
+	}
+	return n
 }
 
 // lineWrapper is copied from package go/doc. It is slightly modified to support
@@ -527,31 +4131,284 @@ type lineWrapper struct {
 	nl        int
 	pendSpace int
 	printed   bool
+	keepNBSP  bool // don't wrap at non-breaking spaces
+	indent    int  // indentation of wrapped continuation lines
+	sentences bool // break lines between sentences
+	sentEnd   bool // the last field written ends a sentence
 }
 
 var nl = []byte("\n")
 var space = []byte(" ")
 
 func (l *lineWrapper) write(text string) {
+	if strings.IndexByte(text, '\n') != -1 && hasWideRune(text) {
+		text = joinWideLines(text)
+	}
+
+	isSpace := unicode.IsSpace
+	if l.keepNBSP {
+		isSpace = isBreakingSpace
+	}
+	fields := strings.FieldsFunc(text, isSpace)
+
+	// Text is joined to the text before it unless either has whitespace
+	// between them.
+	if r, _ := utf8.DecodeRuneInString(text); isSpace(r) && l.n > 0 {
+		l.pendSpace = 1
+	}
+	if len(fields) == 0 {
+		return
+	}
+
 	if l.n == 0 && l.printed {
 		l.flush() // blank line before new paragraph
 	}
+	if l.n == 0 && l.indent > 0 {
+		// Lines within list items are indented like their wrapped lines.
+		io.WriteString(l.out, strings.Repeat(" ", l.indent))
+		l.n = l.indent
+	}
 
 	l.printed = true
 	l.nl = 0
 
-	for _, f := range strings.Fields(text) {
-		w := runewidth.StringWidth(f)
-		// wrap if line is too long
-		if l.n > 0 && l.n+l.pendSpace+w > l.width {
+	for _, f := range fields {
+		w := stringWidth(f)
+		if l.n+l.pendSpace+w > l.width {
+			if strings.Contains(f, urlBreak) {
+				l.writeUnits(strings.SplitAfter(f, urlBreak), urlContinuation)
+				l.pendSpace = 1
+				continue
+			}
+			if hasWideRune(f) {
+				l.writeUnits(wideBreakUnits(f), "")
+				l.pendSpace = 1
+				continue
+			}
+		}
+		// wrap if line is too long, or at the start of a sentence
+		if l.n > l.indent && l.pendSpace > 0 && (l.n+l.pendSpace+w > l.width || l.sentEnd && startsSentence(f)) {
 			l.out.Write(nl)
-			l.n = 0
+			io.WriteString(l.out, strings.Repeat(" ", l.indent))
+			l.n = l.indent
 			l.pendSpace = 0
 		}
 		l.out.Write(space[:l.pendSpace])
-		l.out.Write([]byte(f))
+		io.WriteString(l.out, f)
 		l.n += l.pendSpace + w
 		l.pendSpace = 1
+		l.sentEnd = l.sentences && endsSentence(f)
+	}
+
+	if r, _ := utf8.DecodeLastRuneInString(text); !isSpace(r) {
+		l.pendSpace = 0
+	}
+}
+
+// writeUnits writes a field that lines may be wrapped within between the given
+// units, such as the wide characters of Chinese and Japanese text, which
+// aren't separated by spaces. Lines wrapped within the field end with marker,
+// which is left room for after each unit but the last.
+func (l *lineWrapper) writeUnits(units []string, marker string) {
+	for i, unit := range units {
+		w := stringWidth(unit)
+		room := 0
+		if i < len(units)-1 {
+			room = stringWidth(marker)
+		}
+		pendSpace := 0
+		if i == 0 {
+			pendSpace = l.pendSpace
+		}
+		// The field is joined to the text before it unless there is a space.
+		if l.n > l.indent && (i > 0 || pendSpace > 0) && l.n+pendSpace+w+room > l.width {
+			if i > 0 {
+				io.WriteString(l.out, marker)
+			}
+			l.out.Write(nl)
+			io.WriteString(l.out, strings.Repeat(" ", l.indent))
+			l.n = l.indent
+			pendSpace = 0
+		}
+		l.out.Write(space[:pendSpace])
+		io.WriteString(l.out, unit)
+		l.n += pendSpace + w
+	}
+}
+
+// Punctuation that lines don't start or end with when wrapping between wide
+// characters.
+const (
+	noLineStart = "、。，．・：；？！ー）」』】〉》〕"
+	noLineEnd   = "（「『【〈《〔"
+)
+
+// wideBreakUnits splits f between the wide characters within it, keeping
+// closing punctuation with the text before it and opening punctuation with the
+// text after it.
+func wideBreakUnits(f string) []string {
+	var units []string
+	start := 0
+	var prev rune
+	prevWide := false
+	for i, r := range f {
+		wide := runewidth.RuneWidth(r) == 2
+		if i > start && wide && prevWide &&
+			!strings.ContainsRune(noLineStart, r) && !strings.ContainsRune(noLineEnd, prev) {
+			units = append(units, f[start:i])
+			start = i
+		}
+		prev, prevWide = r, wide
+	}
+	return append(units, f[start:])
+}
+
+// joinWideLines removes the line breaks between wide characters from text, as
+// they are written without spaces between them. Text is rewritten like this
+// whether its lines were wrapped by writeUnits or in the HTML source, as browsers
+// also do.
+func joinWideLines(text string) string {
+	var buf strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			before, _ := utf8.DecodeLastRuneInString(text[:i])
+			after, _ := utf8.DecodeRuneInString(text[i+1:])
+			if runewidth.RuneWidth(before) == 2 && runewidth.RuneWidth(after) == 2 {
+				continue
+			}
+		}
+		buf.WriteByte(text[i])
+	}
+	return buf.String()
+}
+
+// hasWideRune reports whether s contains a wide character.
+func hasWideRune(s string) bool {
+	for _, r := range s {
+		if r >= 0x1100 && runewidth.RuneWidth(r) == 2 {
+			return true
+		}
+	}
+	return false
+}
+
+// isBreakingSpace reports whether r is a space that lines may be wrapped at,
+// which excludes the non-breaking spaces.
+func isBreakingSpace(r rune) bool {
+	switch r {
+	case '\u00A0', '\u2007', '\u202F':
+		return false
+	}
+	return unicode.IsSpace(r)
+}
+
+// stringWidth returns the display width of s, in which ANSI escape sequences
+// take up no space. It avoids the cost of runewidth.StringWidth for the common
+// case of printable ASCII text.
+func stringWidth(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return runewidth.StringWidth(stripANSI(s))
+		}
+	}
+	return len(s)
+}
+
+// stripANSI removes the ANSI control sequences, such as those written for
+// Options.ANSIColors, from s.
+func stripANSI(s string) string {
+	if strings.IndexByte(s, '\x1b') == -1 {
+		return s
+	}
+
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\x1b' || i+1 >= len(s) || s[i+1] != '[' {
+			buf.WriteByte(s[i])
+			continue
+		}
+		// Skip the parameters up to and including the final byte.
+		for i += 2; i < len(s) && (s[i] < 0x40 || s[i] > 0x7E); i++ {
+		}
+	}
+	return buf.String()
+}
+
+// ANSI escape sequences written for Options.ANSIColors.
+const (
+	ansiBold            = "\x1b[1m"
+	ansiItalic          = "\x1b[3m"
+	ansiUnderline       = "\x1b[4m"
+	ansiNormalIntensity = "\x1b[22m"
+	ansiNotItalic       = "\x1b[23m"
+	ansiNotUnderlined   = "\x1b[24m"
+)
+
+// writePre writes preformatted text verbatim, without wrapping it.
+func (l *lineWrapper) writePre(text string) {
+	l.printed = true
+	l.pendSpace = 0
+	io.WriteString(l.out, text)
+
+	i := strings.LastIndexByte(text, '\n')
+	if i == -1 {
+		l.n += stringWidth(text)
+		l.nl = 0
+		return
+	}
+
+	if tail := text[i+1:]; tail != "" {
+		l.n = stringWidth(tail)
+		l.nl = 0
+		return
+	}
+
+	trimmed := strings.TrimRight(text, "\n")
+	if trimmed == "" {
+		l.nl += len(text)
+	} else {
+		l.nl = len(text) - len(trimmed)
+	}
+	l.n = 0
+}
+
+// endsSentence reports whether the field f ends a sentence, which it does if it
+// ends with a full stop, question or exclamation mark, other than one of an
+// initial or an abbreviation such as "e.g.", optionally followed by closing
+// quotes, brackets or emphasis markers.
+func endsSentence(f string) bool {
+	f = strings.TrimRight(f, "\"'”’)]*_~`")
+	if !strings.HasSuffix(f, ".") {
+		return strings.HasSuffix(f, "!") || strings.HasSuffix(f, "?")
+	}
+	word := strings.TrimLeft(strings.TrimSuffix(f, "."), "\"'“‘([*_~`")
+	return utf8.RuneCountInString(word) > 1 && !strings.Contains(word, ".")
+}
+
+// startsSentence reports whether the field f can start a sentence, which it
+// does if it starts with an uppercase letter, optionally preceded by opening
+// quotes, brackets or emphasis markers.
+func startsSentence(f string) bool {
+	r, _ := utf8.DecodeRuneInString(strings.TrimLeft(f, "\"'“‘([*_~`"))
+	return unicode.IsUpper(r)
+}
+
+// writeBlock writes the lines of text, which are already wrapped, as is apart
+// from indenting them like wrapped lines.
+func (l *lineWrapper) writeBlock(text string) {
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			l.writePre("\n")
+		}
+		if line == "" {
+			continue
+		}
+		if l.n == 0 && l.indent > 0 {
+			line = strings.Repeat(" ", l.indent) + line
+		} else if l.n > 0 && l.pendSpace > 0 {
+			line = " " + line
+		}
+		l.writePre(line)
 	}
 }
 
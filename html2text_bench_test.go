@@ -0,0 +1,52 @@
+package html2text
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+var plainTextInput = strings.Repeat(`Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod
+	tempor incididunt ut labore et dolore magna aliqua. 日本語のテキストも含まれています。
+`, 500)
+
+func parseBenchmarkInput(b *testing.B, input string) *html.Node {
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		b.Fatal("failed to parse:", err)
+	}
+	return doc
+}
+
+func BenchmarkPlainText(b *testing.B) {
+	doc := parseBenchmarkInput(b, plainTextInput)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := FromHTMLNode(doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFromString(b *testing.B) {
+	b.Run("plain", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := FromString(plainTextInput); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("paragraphs", func(b *testing.B) {
+		input := "<p>" + strings.Replace(plainTextInput, "\n", "</p><p>", -1) + "</p>"
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := FromString(input); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
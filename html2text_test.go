@@ -1,9 +1,46 @@
 package html2text
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/olekukonko/tablewriter"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
+type testCase struct {
+	name    string
+	input   string
+	options Options
+	output  string
+}
+
+func runTestCases(t *testing.T, cases []testCase) {
+	t.Helper()
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			text, err := FromString(c.input, c.options)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if text != c.output {
+				t.Errorf("unexpected output\ninput:    %q\nexpected: %q\ngot:      %q", c.input, c.output, text)
+			}
+		})
+	}
+}
+
 func Example() {
 	inputHTML := `
 <html>
@@ -94,3 +131,3046 @@ func Example() {
 	// |  FOOTER 1   |  FOOTER 2   |
 	// +-------------+-------------+
 }
+
+func TestOrderedLists(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "ascending",
+			input:  "<ol><li>a</li><li>b</li><li>c</li></ol>",
+			output: "1. a\n2. b\n3. c",
+		},
+		{
+			name:   "start",
+			input:  `<ol start="5"><li>a</li><li>b</li></ol>`,
+			output: "5. a\n6. b",
+		},
+		{
+			name:   "reversed",
+			input:  "<ol reversed><li>a</li><li>b</li><li>c</li></ol>",
+			output: "3. a\n2. b\n1. c",
+		},
+		{
+			name:   "reversed with start",
+			input:  `<ol reversed start="10"><li>a</li><li>b</li></ol>`,
+			output: "10. a\n9. b",
+		},
+		{
+			name:   "item value",
+			input:  `<ol><li>a</li><li>b</li><li value="10">c</li><li>d</li></ol>`,
+			output: "1. a\n2. b\n10. c\n11. d",
+		},
+		{
+			name:   "mixed item values",
+			input:  `<ol><li value="x">a</li><li value=" 5 ">b</li><li>c</li><li value="2">d</li><li>e</li></ol>`,
+			output: "1. a\n5. b\n6. c\n2. d\n3. e",
+		},
+		{
+			name:   "reversed item value",
+			input:  `<ol reversed><li>a</li><li value="10">b</li><li>c</li></ol>`,
+			output: "3. a\n10. b\n9. c",
+		},
+		{
+			name:   "nested item value",
+			input:  `<ol><li>a<ol><li value="7">x</li><li>y</li></ol></li><li>b</li></ol>`,
+			output: "1. a\n\n   7. x\n   8. y\n\n2. b",
+		},
+		{
+			name:   "malformed start",
+			input:  `<ol start="five"><li>a</li><li>b</li></ol>`,
+			output: "1. a\n2. b",
+		},
+		{
+			name:   "nested unordered",
+			input:  "<ol><li>a<ul><li>b</li></ul></li><li>c</li></ol>",
+			output: "1. a\n\n   - b\n\n2. c",
+		},
+		{
+			name:    "text only",
+			input:   "<ol><li>a</li><li>b</li></ol>",
+			options: Options{TextOnly: true},
+			output:  "a\nb",
+		},
+	})
+}
+
+func TestComments(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "stripped by default",
+			input:  "<p>Hello <!-- tracking id: 123 --> world</p>",
+			output: "Hello world",
+		},
+		{
+			name:    "kept",
+			input:   "<p>Hello <!-- tracking id: 123 --> world</p>",
+			options: Options{KeepComments: true},
+			output:  "Hello [comment: tracking id: 123] world",
+		},
+		{
+			name:    "multiline",
+			input:   "<p>Hello<!--\n  template:\n  footer\n-->world<!-- --></p>",
+			options: Options{KeepComments: true},
+			output:  "Hello [comment: template: footer] world",
+		},
+	})
+}
+
+func TestHeadings(t *testing.T) {
+	var words []string
+	for i := 0; i < 25; i++ {
+		words = append(words, fmt.Sprintf("word%02d", i))
+	}
+	longHeading := strings.Join(words, " ")
+
+	runTestCases(t, []testCase{
+		{
+			name:   "default",
+			input:  "<h2>Title</h2><p>Text</p>",
+			output: "Title\n-----\n\nText",
+		},
+		{
+			name:    "tight",
+			input:   "<h2>Title</h2>Text",
+			options: Options{HeadingBottomSpacing: 1},
+			output:  "Title\n-----\nText",
+		},
+		{
+			name:    "tight paragraph",
+			input:   "<h2>Title</h2><p>Text</p><p>More</p>",
+			options: Options{HeadingBottomSpacing: 1},
+			output:  "Title\n-----\nText\n\nMore",
+		},
+		{
+			name:    "tight list",
+			input:   "<h2>Title</h2><ul><li>a</li><li>b</li></ul>",
+			options: Options{HeadingBottomSpacing: 1},
+			output:  "Title\n-----\n- a\n- b",
+		},
+		{
+			name:    "loose paragraph",
+			input:   "<h2>Title</h2><p>Text</p><p>More</p>",
+			options: Options{HeadingBottomSpacing: 3},
+			output:  "Title\n-----\n\n\nText\n\nMore",
+		},
+		{
+			name:    "loose list",
+			input:   "<div><h2>Title</h2></div><ul><li>a</li></ul>",
+			options: Options{HeadingBottomSpacing: 4, TextOnly: true},
+			output:  "Title\n\n\n\na",
+		},
+		{
+			name:   "h1 dividers",
+			input:  "<h1>Title</h1>Text",
+			output: "*****\nTitle\n*****\n\nText",
+		},
+		{
+			name:    "h1 without top divider",
+			input:   "<h1>Title</h1>Text",
+			options: Options{OmitH1TopDivider: true},
+			output:  "Title\n*****\n\nText",
+		},
+		{
+			name:   "wrapped",
+			input:  "<h2>" + longHeading + "</h2>",
+			output: "word00 word01 word02 word03 word04 word05 word06 word07 word08 word09 word10\nword11 word12 word13 word14 word15 word16 word17 word18 word19 word20 word21\nword22 word23 word24\n" + strings.Repeat("-", 76),
+		},
+		{
+			name:   "line breaks",
+			input:  "<h2>Short<br>A much longer second line</h2>",
+			output: "Short\nA much longer second line\n-------------------------",
+		},
+		{
+			name:   "wrapped in list item",
+			input:  "<ol><li>Item</li><li><h2>" + longHeading + "</h2></li></ol>",
+			output: "1. Item\n2. word00 word01 word02 word03 word04 word05 word06 word07 word08 word09\n   word10 word11 word12 word13 word14 word15 word16 word17 word18 word19\n   word20 word21 word22 word23 word24\n   " + strings.Repeat("-", 69),
+		},
+		{
+			name:    "text only",
+			input:   "<h1>Title</h1>Text",
+			options: Options{TextOnly: true},
+			output:  "Title\n\nText",
+		},
+	})
+}
+
+func TestAnchorsWithoutHref(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "name only",
+			input:  `<p>See <a name="section">the section</a> below.</p>`,
+			output: "See the section below.",
+		},
+		{
+			name:   "blank href",
+			input:  `<p><a href=" ">blank</a> and <a href="mailto:">mailto</a></p>`,
+			output: "blank and mailto",
+		},
+	})
+}
+
+func TestBidiElements(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "disabled",
+			input:  `<p>User <bdi>إيان</bdi> scored 90 points</p>`,
+			output: "User إيان scored 90 points",
+		},
+		{
+			name:    "bdi",
+			input:   `<p>User <bdi>إيان</bdi> scored 90 points</p>`,
+			options: Options{BidiControls: true},
+			output:  "User \u2068إيان\u2069 scored 90 points",
+		},
+		{
+			name:    "bdi with dir",
+			input:   `<p><bdi dir="rtl">abc</bdi></p>`,
+			options: Options{BidiControls: true},
+			output:  "\u2067abc\u2069",
+		},
+		{
+			name:    "bdo",
+			input:   `<p><bdo dir="rtl">abc</bdo></p>`,
+			options: Options{BidiControls: true},
+			output:  "\u202Eabc\u202C",
+		},
+		{
+			name:    "bdo segment with markup",
+			input:   `<p>Say <bdo dir="rtl">hello <b>world</b></bdo>!</p>`,
+			options: Options{BidiControls: true},
+			output:  "Say \u202Ehello *world*\u202C!",
+		},
+		{
+			name:    "bdo ltr and without dir",
+			input:   `<p>a <bdo>b</bdo> c <bdo dir="LTR">d</bdo></p>`,
+			options: Options{BidiControls: true},
+			output:  "a b c \u202Dd\u202C",
+		},
+		{
+			name:   "bdo disabled",
+			input:  `<p>Say <bdo dir="rtl">hello</bdo>!</p>`,
+			output: "Say hello!",
+		},
+	})
+}
+
+func TestMaxDepth(t *testing.T) {
+	const depth = 10000
+	input := strings.Repeat("<div>", depth) + "deep" + strings.Repeat("</div>", depth)
+
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal("failed to parse:", err)
+	}
+
+	if _, err := FromHTMLNode(doc, Options{MaxDepth: 100}); err != ErrMaxDepth {
+		t.Fatalf("expected ErrMaxDepth, got %v", err)
+	}
+
+	text, err := FromHTMLNode(doc)
+	if err != nil {
+		t.Fatal("unexpected error without MaxDepth:", err)
+	}
+	if text != "deep" {
+		t.Errorf("unexpected output %q", text)
+	}
+
+	// Content rendered separately, such as table cells and emphasis, counts
+	// toward the same depth.
+	spans := strings.Repeat("<span>", 200) + "x" + strings.Repeat("</span>", 200)
+	for _, input := range []string{
+		"<table><tr><td>" + spans + "</td></tr></table>",
+		"<p><b>" + spans + "</b></p>",
+	} {
+		if _, err := FromString(input, Options{MaxDepth: 100}); !errors.Is(err, ErrMaxDepth) {
+			t.Errorf("expected ErrMaxDepth for %.30q..., got %v", input, err)
+		}
+	}
+}
+
+func TestMaxLength(t *testing.T) {
+	const table = `<table><tr><th>A</th></tr><tr><td>x</td></tr></table>`
+
+	runTestCases(t, []testCase{
+		{
+			name:    "fits",
+			input:   "<p>Hello world</p>",
+			options: Options{MaxLength: 11},
+			output:  "Hello world",
+		},
+		{
+			name:    "truncated",
+			input:   "<p>Hello world</p>",
+			options: Options{MaxLength: 10},
+			output:  "Hello...",
+		},
+		{
+			name:    "first word",
+			input:   "<p>Hello world</p>",
+			options: Options{MaxLength: 7},
+			output:  "Hell...",
+		},
+		{
+			name:    "runes",
+			input:   "<p>こんにちは世界</p>",
+			options: Options{MaxLength: 5},
+			output:  "こん...",
+		},
+		{
+			name:    "stops before table",
+			input:   "<p>Hello world</p>" + table + "<p>after</p>",
+			options: Options{MaxLength: 20, PrettyTables: true},
+			output:  "Hello world\n...",
+		},
+		{
+			name:    "includes whole table",
+			input:   "<p>Hello world</p>" + table + "<p>after</p>",
+			options: Options{MaxLength: 46, PrettyTables: true},
+			output:  "Hello world\n\n+---+\n| A |\n+---+\n| x |\n+---+\n...",
+		},
+		{
+			name:    "transformed output",
+			input:   `<p>Tom &amp; Jerry <a href="http://a.org">run</a> away</p>`,
+			options: Options{MaxLength: 45, Indent: 2, HTMLEntitiesInOutput: true, ReferenceLinks: true, LineEnding: "\r\n", TrailingNewline: true},
+			output:  "  Tom &amp; Jerry...\r\n\r\n  [1]: http://a.org\r\n",
+		},
+		{
+			name:    "no room for references",
+			input:   `<p>Tom and <a href="http://a.org">Jerry</a></p>`,
+			options: Options{MaxLength: 10, ReferenceLinks: true},
+			output:  "Tom and...",
+		},
+	})
+
+	input := `<h1>Title</h1><p>Some <b>bold</b> text &amp; <a href="http://a.org/x">a link</a>.</p>` +
+		`<table><tr><th>A</th><th>B</th></tr><tr><td>1</td><td>2</td></tr></table><p>` + strings.Repeat("more words ", 20) + `</p>`
+	for _, options := range []Options{
+		{},
+		{PrettyTables: true, ReferenceLinks: true},
+		{Indent: 4, HTMLEntitiesInOutput: true, LineEnding: "\r\n", TrailingNewline: true},
+	} {
+		for max := 1; max <= 200; max++ {
+			options.MaxLength = max
+			text, err := FromString(input, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := utf8.RuneCountInString(text); n > max {
+				t.Errorf("MaxLength %d with %+v: output is %d runes long: %q", max, options, n, text)
+			}
+		}
+	}
+}
+
+func TestTableSeparators(t *testing.T) {
+	const tables = `<table><tr><td>a</td></tr></table>
+		<table><tr><td>b</td></tr></table>
+		<p>text</p>
+		<table><tr><td>c</td></tr></table>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "default",
+			input:  tables,
+			output: "a\n\nb\n\ntext\n\nc",
+		},
+		{
+			name:    "separator",
+			input:   tables,
+			options: Options{TableSeparator: "~~~"},
+			output:  "a\n\n~~~\n\nb\n\ntext\n\nc",
+		},
+		{
+			name:    "numbered",
+			input:   tables,
+			options: Options{TableSeparator: "~~~", NumberTables: true, PrettyTables: true},
+			output: "Table 1\n\n+---+\n| a |\n+---+\n\n~~~\n\n" +
+				"Table 2\n\n+---+\n| b |\n+---+\n\ntext\n\n" +
+				"Table 3\n\n+---+\n| c |\n+---+",
+		},
+		{
+			name:    "numbered in block link",
+			input:   `<table><tr><td>a</td></tr></table><a href="/x"><table><tr><td>b</td></tr></table></a>`,
+			options: Options{NumberTables: true, PrettyTables: true},
+			output: "Table 1\n\n+---+\n| a |\n+---+\n\n" +
+				"Table 2\n\n+---+\n| b |\n+---+ (/x)",
+		},
+	})
+}
+
+func TestFieldset(t *testing.T) {
+	const input = `<p>Before</p>
+		<fieldset>
+			<legend>Account</legend>
+			<div>Username: <input name="user"></div>
+			<div>Password: <input name="pass" type="password"></div>
+		</fieldset>
+		<p>After</p>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "legend as heading",
+			input:  input,
+			output: "Before\n\nAccount\n-------\n\nUsername:\nPassword:\n\nAfter",
+		},
+		{
+			name:    "text only",
+			input:   input,
+			options: Options{TextOnly: true},
+			output:  "Before\n\nAccount\n\nUsername:\nPassword:\n\nAfter",
+		},
+	})
+}
+
+func TestPlainText(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "text",
+			input:  "Hello, world!",
+			output: "Hello, world!",
+		},
+		{
+			name:   "surrounding space",
+			input:  "  leading and trailing  ",
+			output: "leading and trailing",
+		},
+		{
+			name:   "document",
+			input:  "<!DOCTYPE html><html><head><title>Title</title></head><body>Body text</body></html>",
+			output: "Body text",
+		},
+		{
+			name:   "comment",
+			input:  "Before <!-- comment --> after",
+			output: "Before after",
+		},
+	})
+}
+
+func TestStrictTables(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{
+			name:  "well formed",
+			input: `<table><tr><th>A</th><th>B</th></tr><tr><td>1</td><td>2</td></tr></table>`,
+		},
+		{
+			name: "spans",
+			input: `<table>
+				<tr><th colspan="2">A</th><th>B</th></tr>
+				<tr><td rowspan="2">1</td><td>2</td><td>3</td></tr>
+				<tr><td>4</td><td>5</td></tr>
+			</table>`,
+		},
+		{
+			name: "ragged",
+			input: `<table><tr><td>a</td></tr></table>
+				<table>
+					<tr><th>A</th><th>B</th></tr>
+					<tr><td>1</td><td>2</td></tr>
+					<tr><td>3</td></tr>
+				</table>`,
+			err: "html2text: malformed table: table 2 row 3 spans 1 columns, expected 2",
+		},
+	}
+
+	for _, options := range []Options{
+		{PrettyTables: true, StrictTables: true},
+		{TablesAsCSV: true, StrictTables: true},
+		{StrictTables: true},
+	} {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				_, err := FromString(test.input, options)
+				if test.err == "" {
+					if err != nil {
+						t.Fatal("unexpected error:", err)
+					}
+					return
+				}
+				if !errors.Is(err, ErrMalformedTable) || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+			})
+		}
+	}
+}
+
+func TestNBSP(t *testing.T) {
+	const input = "<p>" +
+		"The&nbsp;quick&nbsp;brown&nbsp;fox&nbsp;jumps&nbsp;over&nbsp;the&nbsp;lazy&nbsp;dog. " +
+		"The&nbsp;quick&nbsp;brown&nbsp;fox&nbsp;jumps&nbsp;over&nbsp;the&nbsp;lazy&nbsp;dog." +
+		"</p><p>&nbsp;</p>"
+
+	runTestCases(t, []testCase{
+		{
+			name:   "normalized",
+			input:  input,
+			output: "The quick brown fox jumps over the lazy dog. The quick brown fox jumps over\nthe lazy dog.",
+		},
+		{
+			name:    "kept",
+			input:   input,
+			options: Options{KeepNBSP: true},
+			output: strings.Replace("The quick brown fox jumps over the lazy dog.\n"+
+				"The quick brown fox jumps over the lazy dog.", " ", "\u00A0", -1),
+		},
+	})
+}
+
+func TestGauges(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "disabled",
+			input:  `<p>Upload: <progress value="70" max="100">70 percent</progress></p>`,
+			output: "Upload: 70 percent",
+		},
+		{
+			name:    "progress",
+			input:   `<p>Upload: <progress value="70" max="100">70 percent</progress></p>`,
+			options: Options{RenderGauges: true},
+			output:  "Upload: [=======---] 70%",
+		},
+		{
+			name:    "missing max",
+			input:   `<p><progress value="25"></progress></p>`,
+			options: Options{RenderGauges: true, GaugeWidth: 4},
+			output:  "[=---] 25%",
+		},
+		{
+			name:    "zero max",
+			input:   `<p><progress value="50" max="0"></progress></p>`,
+			options: Options{RenderGauges: true, GaugeWidth: 4},
+			output:  "[==--] 50%",
+		},
+		{
+			name:    "indeterminate",
+			input:   `<p><progress>Loading</progress></p>`,
+			options: Options{RenderGauges: true},
+			output:  "Loading",
+		},
+		{
+			name:    "meter",
+			input:   `<p>Disk: <meter min="0" max="512" value="128">128 GB</meter></p>`,
+			options: Options{RenderGauges: true},
+			output:  "Disk: [===-------] 25%",
+		},
+		{
+			name:    "text only",
+			input:   `<p>Disk: <meter min="0" max="512" value="128">128 GB</meter></p>`,
+			options: Options{RenderGauges: true, TextOnly: true},
+			output:  "Disk: 25%",
+		},
+	})
+}
+
+func TestLinkDedupWindow(t *testing.T) {
+	const input = `<p>
+		<a href="/home">Home</a> <a href="/home">Start</a> <b><a href="/home">Go</a></b>
+		<a href="/about">About</a> <a href="/home">Home</a>
+	</p>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "disabled",
+			input:  input,
+			output: "Home (/home) Start (/home) *Go (/home)* About (/about) Home (/home)",
+		},
+		{
+			name:    "adjacent",
+			input:   input,
+			options: Options{LinkDedupWindow: 1},
+			output:  "Home (/home) Start *Go* About (/about) Home (/home)",
+		},
+		{
+			name:    "window",
+			input:   input,
+			options: Options{LinkDedupWindow: 2},
+			output:  "Home (/home) Start *Go* About (/about) Home",
+		},
+		{
+			name:    "table cells",
+			input:   `<table><tr><td><a href="/x">a</a></td><td><a href="/x">b</a></td></tr></table>`,
+			options: Options{LinkDedupWindow: 1, PrettyTables: true},
+			output:  "+--------+---+\n| a (/x) | b |\n+--------+---+",
+		},
+	})
+}
+
+func TestURLNormalizer(t *testing.T) {
+	normalize := func(link string) string {
+		u, err := url.Parse(link)
+		if err != nil {
+			return link
+		}
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Host = strings.ToLower(u.Host)
+		if u.Port() == "443" && u.Scheme == "https" {
+			u.Host = u.Hostname()
+		}
+		return u.String()
+	}
+
+	runTestCases(t, []testCase{
+		{
+			name:   "identity",
+			input:  `<a href="HTTPS://Example.COM:443/Path">link</a>`,
+			output: "link (HTTPS://Example.COM:443/Path)",
+		},
+		{
+			name:    "normalized",
+			input:   `<a href=" HTTPS://Example.COM:443/Path ">link</a>`,
+			options: Options{URLNormalizer: normalize},
+			output:  "link (https://example.com/Path)",
+		},
+		{
+			name:    "dropped",
+			input:   `<a href="https://example.com">link</a>`,
+			options: Options{URLNormalizer: func(string) string { return "" }},
+			output:  "link",
+		},
+	})
+}
+
+func TestStripTrackingParams(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "utm params",
+			input:   `<a href="https://example.com/p?id=3&utm_source=news&utm_medium=email&ref=a#top">link</a>`,
+			options: Options{StripTrackingParams: true},
+			output:  "link (https://example.com/p?id=3&ref=a#top)",
+		},
+		{
+			name:    "only tracking params",
+			input:   `<a href="https://example.com/?utm_source=news&fbclid=123">link</a>`,
+			options: Options{StripTrackingParams: true},
+			output:  "link (https://example.com/)",
+		},
+		{
+			name:    "custom params",
+			input:   `<a href="https://example.com/?utm_source=news&session=1&s_x=2">link</a>`,
+			options: Options{StripTrackingParams: true, TrackingParams: []string{"session", "s_*"}},
+			output:  "link (https://example.com/?utm_source=news)",
+		},
+		{
+			name:   "disabled",
+			input:  `<a href="https://example.com/?utm_source=news">link</a>`,
+			output: "link (https://example.com/?utm_source=news)",
+		},
+	})
+}
+
+func TestMaxLinkTextLength(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "url as text",
+			input:   `<p>Read <a href="https://example.com/2024/05/some-article">https://example.com/2024/05/some-article</a> now.</p>`,
+			options: Options{MaxLinkTextLength: 20},
+			output:  "Read https://example.com/... (https://example.com/2024/05/some-article) now.",
+		},
+		{
+			name:    "short text kept",
+			input:   `<p><a href="/x">short <b>text</b></a></p>`,
+			options: Options{MaxLinkTextLength: 20},
+			output:  "short *text* (/x)",
+		},
+		{
+			name:    "markup dropped when truncated",
+			input:   `<ul><li><a href="/a">A very long <b>bold</b> link text</a></li></ul>`,
+			options: Options{MaxLinkTextLength: 12},
+			output:  "- A very long... (/a)",
+		},
+		{
+			name:    "image alt text",
+			input:   `<a href="/i"><img alt="A picture of a very long thing"></a>`,
+			options: Options{MaxLinkTextLength: 11},
+			output:  "A picture o... (/i)",
+		},
+	})
+}
+
+func TestLinkPlacement(t *testing.T) {
+	const input = `<p>Read <a href="http://x.org/docs">the docs</a> now.</p><ul><li><a href="/a">A</a></li><li><a href="/b">B</a></li></ul>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "after text",
+			input:  input,
+			output: "Read the docs (http://x.org/docs) now.\n\n- A (/a)\n- B (/b)",
+		},
+		{
+			name:    "before text",
+			input:   input,
+			options: Options{LinkPlacement: LinkBeforeText},
+			output:  "Read (http://x.org/docs) the docs now.\n\n- (/a) A\n- (/b) B",
+		},
+		{
+			name:    "separate line",
+			input:   input,
+			options: Options{LinkPlacement: LinkOnSeparateLine},
+			output:  "Read the docs\n(http://x.org/docs)\nnow.\n\n- A\n  (/a)\n- B\n  (/b)",
+		},
+		{
+			name:    "omitted href",
+			input:   `<p>Go <a name="top">up</a>.</p>`,
+			options: Options{LinkPlacement: LinkOnSeparateLine},
+			output:  "Go up.",
+		},
+	})
+
+	if _, err := FromString(input, Options{LinkPlacement: 3}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected ErrInvalidOptions for an unknown LinkPlacement, got %v", err)
+	}
+}
+
+func TestLinkSpacing(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "single text node",
+			input:  `<p>a <a href="http://x.org">link</a>b</p>`,
+			output: "a link (http://x.org)b",
+		},
+		{
+			name:   "single text node with trailing space",
+			input:  `<p>a <a href="http://x.org">link </a>b</p>`,
+			output: "a link (http://x.org) b",
+		},
+		{
+			name:   "multiple children",
+			input:  `<p>a <a href="http://x.org"><b>bold</b> text</a>b</p>`,
+			output: "a *bold* text (http://x.org)b",
+		},
+		{
+			name:   "multiple children with trailing space",
+			input:  `<p>a <a href="http://x.org"><b>bold</b> <i>text</i> </a>b</p>`,
+			output: "a *bold* _text_ (http://x.org) b",
+		},
+		{
+			name:    "before text with leading space",
+			input:   `<p>a<a href="http://x.org"> <b>bold</b> text</a>b</p>`,
+			options: Options{LinkPlacement: LinkBeforeText},
+			output:  "a (http://x.org) *bold* textb",
+		},
+		{
+			name:   "in table",
+			input:  `<table><tr><td><a href="http://x.org">link </a>b</td></tr></table>`,
+			output: "link (http://x.org) b",
+		},
+	})
+}
+
+func TestBlockLinks(t *testing.T) {
+	const input = `<p>Before</p><a href="http://x.org/post"><div><h3>Title</h3><p>Summary text</p></div></a><p>After</p>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "after text",
+			input:  input,
+			output: "Before\n\nTitle\n-----\n\nSummary text (http://x.org/post)\n\nAfter",
+		},
+		{
+			name:    "before text",
+			input:   input,
+			options: Options{LinkPlacement: LinkBeforeText},
+			output:  "Before\n\n(http://x.org/post)\nTitle\n-----\n\nSummary text\n\nAfter",
+		},
+		{
+			name:    "separate line",
+			input:   input,
+			options: Options{LinkPlacement: LinkOnSeparateLine},
+			output:  "Before\n\nTitle\n-----\n\nSummary text\n(http://x.org/post)\n\nAfter",
+		},
+		{
+			name:    "reference",
+			input:   input,
+			options: Options{ReferenceLinks: true},
+			output:  "Before\n\nTitle\n-----\n\nSummary text [1]\n\nAfter\n\n[1]: http://x.org/post",
+		},
+		{
+			name:   "multiple divs",
+			input:  `<a href="http://x.org/post"><div>one</div><div>two</div></a>after`,
+			output: "one\ntwo (http://x.org/post)\n\nafter",
+		},
+		{
+			name:   "list item",
+			input:  `<ul><li><a href="/a"><div>one</div><div>two</div></a></li><li>b</li></ul>`,
+			output: "- one\n  two (/a)\n- b",
+		},
+	})
+}
+
+func TestWrapURLs(t *testing.T) {
+	const input = `<p>See <a href="https://example.com/a/very/long/path/to/some/resource/that/goes/on/and/on?query=value&other=thing&more=stuff">the docs</a> for details.</p>`
+
+	runTestCases(t, []testCase{
+		{
+			name:    "long url",
+			input:   input,
+			options: Options{WrapURLs: true},
+			output:  "See the docs (https://example.com/a/very/long/path/to/some/resource/that/\\\ngoes/on/and/on?query=value&other=thing&more=stuff) for details.",
+		},
+		{
+			name:    "query",
+			input:   `<p><a href="https://example.com/search?q=` + strings.Repeat("x", 30) + `&page=2&sort=` + strings.Repeat("y", 30) + `">results</a></p>`,
+			options: Options{WrapURLs: true},
+			output:  "results (https://example.com/search?q=" + strings.Repeat("x", 30) + "&page=2&\\\nsort=" + strings.Repeat("y", 30) + ")",
+		},
+		{
+			name:    "list item",
+			input:   `<ul><li><a href="https://example.com/` + strings.Repeat("segment/", 15) + `end">docs</a></li></ul>`,
+			options: Options{WrapURLs: true},
+			output: "- docs (https://example.com/segment/segment/segment/segment/segment/segment/\\\n" +
+				"  segment/segment/segment/segment/segment/segment/segment/segment/segment/end)",
+		},
+		{
+			name:    "short url",
+			input:   `<p>See <a href="https://example.com/a/b">the docs</a>.</p>`,
+			options: Options{WrapURLs: true},
+			output:  "See the docs (https://example.com/a/b).",
+		},
+		{
+			name:   "disabled",
+			input:  input,
+			output: "See the docs\n(https://example.com/a/very/long/path/to/some/resource/that/goes/on/and/on?query=value&other=thing&more=stuff)\nfor details.",
+		},
+	})
+}
+
+func TestDivSpacing(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "text after div",
+			input:  "<div>a</div>b",
+			output: "a\nb",
+		},
+		{
+			name:   "adjacent divs",
+			input:  "<div>a</div><div>b</div>",
+			output: "a\nb",
+		},
+		{
+			name:   "text after nested div",
+			input:  "<div><div>a</div>b</div>c",
+			output: "a\nb\nc",
+		},
+		{
+			name:   "nested divs",
+			input:  "<div><div>a</div></div><div>b</div>",
+			output: "a\nb",
+		},
+	})
+}
+
+func TestListHangingIndent(t *testing.T) {
+	const item = "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod " +
+		"tempor incididunt ut labore et dolore magna aliqua."
+
+	runTestCases(t, []testCase{
+		{
+			name:  "unordered",
+			input: "<ul><li>" + item + "</li><li>short</li></ul>",
+			output: "- Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod\n" +
+				"  tempor incididunt ut labore et dolore magna aliqua.\n" +
+				"- short",
+		},
+		{
+			name:  "ordered",
+			input: `<ol start="9"><li>` + item + "</li><li>short</li></ol>",
+			output: "9. Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod\n" +
+				"   tempor incididunt ut labore et dolore magna aliqua.\n" +
+				"10. short",
+		},
+		{
+			name:    "text only",
+			input:   "<ul><li>" + item + "</li></ul>",
+			options: Options{TextOnly: true},
+			output: "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor\n" +
+				"incididunt ut labore et dolore magna aliqua.",
+		},
+	})
+}
+
+func TestHTMLEntitiesInOutput(t *testing.T) {
+	const input = `<p>if a &lt; b &amp;&amp; b &gt; c { return &quot;&amp;amp;&quot; }</p>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "disabled",
+			input:  input,
+			output: `if a < b && b > c { return "&amp;" }`,
+		},
+		{
+			name:    "escaped",
+			input:   input,
+			options: Options{HTMLEntitiesInOutput: true},
+			output:  `if a &lt; b &amp;&amp; b &gt; c { return "&amp;amp;" }`,
+		},
+	})
+}
+
+func TestEmphasis(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "italic",
+			input:  "<p><em>text</em> and <i>more</i></p>",
+			output: "_text_ and _more_",
+		},
+		{
+			name:   "mixed",
+			input:  "<p><strong><em>text</em></strong></p>",
+			output: "*_text_*",
+		},
+		{
+			name:   "collapsed",
+			input:  "<p><strong>a <b>b</b> <em>c <i>d</i></em></strong></p>",
+			output: "*a b _c d_*",
+		},
+		{
+			name:    "kept",
+			input:   "<p><strong><strong>text</strong></strong></p>",
+			options: Options{KeepNestedEmphasis: true},
+			output:  "**text**",
+		},
+		{
+			name:    "custom delimiters",
+			input:   "<p>2 * 3 is <b>six</b>, <i>not</i> <strong><em>seven</em></strong></p>",
+			options: Options{BoldDelimiter: "**", EmphasisDelimiter: "__"},
+			output:  "2 * 3 is **six**, __not__ **__seven__**",
+		},
+		{
+			name:    "text only",
+			input:   "<p><strong><em>text</em></strong></p>",
+			options: Options{TextOnly: true},
+			output:  "text",
+		},
+	})
+}
+
+func TestTableSections(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name: "td in thead",
+			input: `<table>
+				<thead><tr><td>Name</td><td>Age</td></tr></thead>
+				<tbody><tr><td>Alice</td><td>30</td></tr></tbody>
+			</table>`,
+			options: Options{PrettyTables: true},
+			output: "" +
+				"+-------+-----+\n" +
+				"| NAME  | AGE |\n" +
+				"+-------+-----+\n" +
+				"| Alice |  30 |\n" +
+				"+-------+-----+",
+		},
+		{
+			name:    "empty rows",
+			input:   emptyRowsTable,
+			options: Options{PrettyTables: true, StrictTables: true},
+			output: "" +
+				"+---+---+\n" +
+				"| a | 1 |\n" +
+				"| b | 2 |\n" +
+				"+---+---+",
+		},
+		{
+			name:    "empty rows with plain columns",
+			input:   emptyRowsTable,
+			options: Options{PlainTableColumnPadding: &PlainTableColumnPadding{}, StrictTables: true},
+			output:  "a  1\nb  2",
+		},
+		{
+			name:   "tfoot before tbody",
+			input:  footerFirstTable,
+			output: "a1b2Total3",
+		},
+		{
+			name:    "tfoot before tbody with plain columns",
+			input:   footerFirstTable,
+			options: Options{PlainTableColumnPadding: &PlainTableColumnPadding{}},
+			output:  "a      1\nb      2\nTotal  3",
+		},
+	})
+}
+
+const emptyRowsTable = `<table>
+	<tr></tr>
+	<tr><td>a</td><td>1</td></tr>
+	<tr> </tr>
+	<tr><td>b</td><td>2</td></tr>
+	<tr></tr>
+</table>`
+
+const footerFirstTable = `<table>
+	<tfoot><tr><td>Total</td><td>3</td></tr></tfoot>
+	<tbody><tr><td>a</td><td>1</td></tr><tr><td>b</td><td>2</td></tr></tbody>
+</table>`
+
+func TestPreformatted(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "pre",
+			input:  "<p>Code:</p><pre>func main() {\n    fmt.Println(\"hi\")\n}</pre><p>Done.</p>",
+			output: "Code:\n\nfunc main() {\n    fmt.Println(\"hi\")\n}\n\nDone.",
+		},
+		{
+			name:   "white-space pre",
+			input:  "<p>Code:</p><div style=\"color: red; white-space: pre\">if x {\n    y()\n}</div><p>Done.</p>",
+			output: "Code:\n\nif x {\n    y()\n}\n\nDone.",
+		},
+		{
+			name:   "white-space pre-wrap",
+			input:  "<p><span style=\"WHITE-SPACE:PRE-WRAP\">a  b</span></p>",
+			output: "a  b",
+		},
+		{
+			name:   "white-space normal",
+			input:  "<p><span style=\"white-space: normal\">a  b</span></p>",
+			output: "a b",
+		},
+	})
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	text, err := FromString("<p>Hello, <b>world</b></p><p>Bye.</p>", Options{Writer: &buf})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if text != "Hello, *world*\n\nBye." {
+		t.Errorf("unexpected output %q", text)
+	}
+	if buf.String() != text {
+		t.Errorf("expected writer to receive %q, got %q", text, buf.String())
+	}
+}
+
+func TestColumnAlignment(t *testing.T) {
+	const input = `<table>
+		<colgroup><col align="right"><col style="text-align: center"><col></colgroup>
+		<tr><th>Name</th><th>Qty</th><th>Note</th></tr>
+		<tr><td>a</td><td>1</td><td>long note</td></tr>
+		<tr><td>apple pie</td><td>12345</td><td>x</td></tr>
+	</table>`
+
+	options := NewPrettyTablesOptions()
+	options.ColumnAlignment = []int{tablewriter.ALIGN_DEFAULT, tablewriter.ALIGN_LEFT}
+
+	runTestCases(t, []testCase{
+		{
+			name:    "col",
+			input:   input,
+			options: Options{PrettyTables: true},
+			output: "" +
+				"+-----------+-------+-----------+\n" +
+				"|   NAME    |  QTY  |   NOTE    |\n" +
+				"+-----------+-------+-----------+\n" +
+				"|         a |   1   | long note |\n" +
+				"| apple pie | 12345 | x         |\n" +
+				"+-----------+-------+-----------+",
+		},
+		{
+			name:    "colgroup span",
+			input:   `<table><colgroup span="2" align="right"></colgroup><tr><td>a</td><td>bb</td><td>c</td></tr><tr><td>aaa</td><td>b</td><td>ccc</td></tr></table>`,
+			options: Options{PrettyTables: true},
+			output: "" +
+				"+-----+----+-----+\n" +
+				"|   a | bb | c   |\n" +
+				"| aaa |  b | ccc |\n" +
+				"+-----+----+-----+",
+		},
+		{
+			name:    "options take precedence",
+			input:   input,
+			options: Options{PrettyTables: true, PrettyTablesOptions: options},
+			output: "" +
+				"+-----------+-------+-----------+\n" +
+				"|   NAME    |  QTY  |   NOTE    |\n" +
+				"+-----------+-------+-----------+\n" +
+				"|         a | 1     | long note |\n" +
+				"| apple pie | 12345 | x         |\n" +
+				"+-----------+-------+-----------+",
+		},
+	})
+}
+
+func TestPlainTableColumnPadding(t *testing.T) {
+	const input = `<table>
+		<thead><tr><th>Name</th><th>Age</th><th>City</th></tr></thead>
+		<tfoot><tr><td>Total</td><td>2</td><td></td></tr></tfoot>
+		<tbody>
+			<tr><td>Alice Smith</td><td>30</td><td>Paris</td></tr>
+			<tr><td>Bob</td><td>4</td><td>New York</td></tr>
+			<tr><td>山田太郎</td><td>101</td><td>東京</td></tr>
+		</tbody>
+	</table>`
+
+	runTestCases(t, []testCase{
+		{
+			name:    "default",
+			input:   input,
+			options: Options{PlainTableColumnPadding: &PlainTableColumnPadding{}},
+			output: "" +
+				"Name         Age  City\n" +
+				"Alice Smith  30   Paris\n" +
+				"Bob          4    New York\n" +
+				"山田太郎     101  東京\n" +
+				"Total        2",
+		},
+		{
+			name:  "custom",
+			input: input,
+			options: Options{PlainTableColumnPadding: &PlainTableColumnPadding{
+				MinWidth:  5,
+				Padding:   '.',
+				Separator: " ",
+			}},
+			output: "" +
+				"Name....... Age.. City\n" +
+				"Alice Smith 30... Paris\n" +
+				"Bob........ 4.... New York\n" +
+				"山田太郎... 101.. 東京\n" +
+				"Total...... 2....",
+		},
+	})
+}
+
+func TestTableCellBreaks(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "br in cell",
+			input:   "<table><tr><td>a<br>b</td><td>c<br/><br/>d</td></tr></table>",
+			options: Options{PrettyTables: true},
+			output: "" +
+				"+---+---+\n" +
+				"| a | c |\n" +
+				"| b | d |\n" +
+				"+---+---+",
+		},
+	})
+}
+
+func TestTrace(t *testing.T) {
+	var trace []string
+	options := Options{
+		Trace: func(node *html.Node, action string) {
+			data := node.Data
+			if node.Type == html.TextNode {
+				data = strconv.Quote(data)
+			}
+			trace = append(trace, action+" "+data)
+		},
+	}
+
+	_, err := FromString(`<p>Hi <b>there</b></p><!-- note --><script>x()</script>`, options)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	expected := []string{
+		"enter html",
+		"enter head",
+		"skip head",
+		"enter body",
+		"enter p",
+		`emit "Hi "`,
+		"enter b",
+		`emit "there"`,
+		"skip  note ",
+		"enter script",
+		"skip script",
+	}
+	if strings.Join(trace, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected trace\nexpected: %q\ngot:      %q", expected, trace)
+	}
+}
+
+func TestListItemBlocks(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "paragraph items",
+			input:  "<p>Steps:</p>\n<ol>\n  <li><p>Download</p></li>\n  <li><p>Install</p></li>\n  <li><p>Run</p></li>\n</ol>\n<p>Done.</p>",
+			output: "Steps:\n\n1. Download\n2. Install\n3. Run\n\nDone.",
+		},
+		{
+			name:   "paragraph task items",
+			input:  "<ul><li><p><input type=checkbox checked> Done</p></li><li><p><input type=checkbox> Todo</p></li></ul>",
+			output: "- [x] Done\n- [ ] Todo",
+		},
+		{
+			name:   "paragraphs",
+			input:  "<ul><li><p>First para</p><p>Second para</p></li><li>Two</li></ul>",
+			output: "- First para\n\n  Second para\n\n- Two",
+		},
+		{
+			name:   "text then paragraph",
+			input:  "<ol><li>Text<p>Para</p></li><li>Two</li></ol>",
+			output: "1. Text\n\n   Para\n\n2. Two",
+		},
+		{
+			name:   "divs",
+			input:  "<ul><li><div>In div</div><div>Next</div></li><li>Two</li></ul>",
+			output: "- In div\n  Next\n- Two",
+		},
+		{
+			name:   "wrapped paragraph",
+			input:  "<ul><li><p>" + strings.Repeat("word ", 20) + "</p></li></ul>",
+			output: "- " + strings.TrimSpace(strings.Repeat("word ", 15)) + "\n  " + strings.TrimSpace(strings.Repeat("word ", 5)),
+		},
+		{
+			name:    "text only",
+			input:   "<ul><li><p>First</p><p>Second</p></li></ul>",
+			options: Options{TextOnly: true},
+			output:  "First\n\nSecond",
+		},
+	})
+}
+
+func TestTaskLists(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name: "checkboxes",
+			input: `<ul>
+				<li><input type="checkbox" checked disabled> Done</li>
+				<li><input type="checkbox" disabled> Not done</li>
+				<li>Plain</li>
+			</ul>`,
+			output: "- [x] Done\n- [ ] Not done\n- Plain",
+		},
+		{
+			name:   "ordered",
+			input:  `<ol><li><input type="CHECKBOX"> First</li><li><input type="text"> Second</li></ol>`,
+			output: "1. [ ] First\n2. Second",
+		},
+		{
+			name:   "wrapped",
+			input:  `<ul><li><input type="checkbox" checked>` + strings.Repeat(" word", 16) + `</li></ul>`,
+			output: "- [x] word word word word word word word word word word word word word word\n      word word",
+		},
+	})
+}
+
+func TestCyclicTree(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader("<p>a</p><p>b</p>"))
+	if err != nil {
+		t.Fatal("failed to parse:", err)
+	}
+
+	text, err := FromHTMLNode(doc)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if text != "a\n\nb" {
+		t.Fatalf("unexpected output %q", text)
+	}
+
+	// Find the body and make its last paragraph loop back to the first.
+	body := doc.FirstChild.LastChild
+	body.LastChild.NextSibling = body.FirstChild
+
+	if _, err := FromHTMLNode(doc); err != ErrCyclicTree {
+		t.Errorf("expected ErrCyclicTree for cyclic siblings, got %v", err)
+	}
+
+	// Make a node its own descendant.
+	body.LastChild.NextSibling = nil
+	body.LastChild.FirstChild = body
+
+	if _, err := FromHTMLNode(doc); err != ErrCyclicTree {
+		t.Errorf("expected ErrCyclicTree for cyclic children, got %v", err)
+	}
+
+	// Make the parents of a node loop, within and above the document.
+	body.LastChild.FirstChild = nil
+	p := body.FirstChild
+	for _, start := range []*html.Node{p, doc} {
+		parent := start.Parent
+		start.Parent = p.FirstChild
+		p.FirstChild.Parent = start
+		for _, options := range []Options{{HeadingAnchors: true}, {ShowLang: true}} {
+			if _, err := FromHTMLNode(doc, options); err != ErrCyclicTree {
+				t.Errorf("expected ErrCyclicTree for cyclic parents above %v with %+v, got %v", start.Data, options, err)
+			}
+		}
+		start.Parent = parent
+		p.FirstChild.Parent = p
+	}
+}
+
+func TestTextTransformer(t *testing.T) {
+	redact := regexp.MustCompile(`\d{3}-\d{4}`)
+	options := Options{
+		TextTransformer: func(s string) string {
+			return redact.ReplaceAllString(s, "XXX-XXXX")
+		},
+	}
+
+	runTestCases(t, []testCase{
+		{
+			name:    "plain",
+			input:   "Call 555-1234 now",
+			options: options,
+			output:  "Call XXX-XXXX now",
+		},
+		{
+			name:    "formatted",
+			input:   `<p>Call <b>555-1234</b> or <a href="tel:555-9876">555-9876</a></p>`,
+			options: options,
+			output:  "Call *XXX-XXXX* or XXX-XXXX (tel:555-9876)",
+		},
+	})
+}
+
+func TestLinkSchemeWhitelist(t *testing.T) {
+	const input = `<p>
+		<a href="http://example.com">web</a>
+		<a href="HTTPS://example.com/secure">secure</a>
+		<a href="ftp://example.com/file">ftp</a>
+		<a href="data:text/html,<script>alert(1)</script>">data</a>
+		<a href="javascript:alert(1)">js</a>
+		<a href="/relative">relative</a>
+	</p>`
+
+	runTestCases(t, []testCase{
+		{
+			name:    "whitelisted",
+			input:   input,
+			options: Options{LinkSchemeWhitelist: []string{"http", "https"}},
+			output:  "web (http://example.com) secure (HTTPS://example.com/secure) ftp data js\nrelative (/relative)",
+		},
+		{
+			name:    "empty whitelist",
+			input:   `<a href="http://example.com">web</a>`,
+			options: Options{LinkSchemeWhitelist: []string{}},
+			output:  "web",
+		},
+	})
+}
+
+func TestDetails(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "closed",
+			input:  "<p>Before</p><details><summary>More info</summary><p>Hidden text.</p></details><p>After</p>",
+			output: "Before\n\n▸ More info\n\nHidden text.\n\nAfter",
+		},
+		{
+			name:   "open",
+			input:  "<details open><summary>More <b>info</b></summary>Shown text.</details>",
+			output: "▾ More *info*\nShown text.",
+		},
+		{
+			name:    "in table cell",
+			input:   "<table><tr><th>Name</th><th>Info</th></tr><tr><td>a</td><td><details><summary>More</summary><p>Hidden text</p><p>Second</p></details></td></tr></table>",
+			options: Options{PrettyTables: true},
+			output:  "+------+-------------+\n| NAME |    INFO     |\n+------+-------------+\n| a    | ▸ More      |\n|      | Hidden text |\n|      | Second      |\n+------+-------------+",
+		},
+		{
+			name:   "summary last",
+			input:  "<details>Text first.<summary>Title</summary></details>",
+			output: "▸ Title\nText first.",
+		},
+		{
+			name:    "text only",
+			input:   "<details open><summary>More info</summary>Shown text.</details>",
+			options: Options{TextOnly: true},
+			output:  "More info\nShown text.",
+		},
+		{
+			name:   "orphan summary",
+			input:  "before<summary>Orphan <b>title</b></summary>after",
+			output: "before\nOrphan *title*\nafter",
+		},
+		{
+			name:   "orphan summary between paragraphs",
+			input:  "<p>x</p><summary>Orphan</summary><p>y</p>",
+			output: "x\n\nOrphan\n\ny",
+		},
+	})
+}
+
+func TestImages(t *testing.T) {
+	const dataURI = "data:image/png;base64,iVBORw0KGgo="
+
+	runTestCases(t, []testCase{
+		{
+			name:   "omitted by default",
+			input:  `<p>Logo: <img src="/logo.png" alt="ACME"></p>`,
+			output: "Logo:",
+		},
+		{
+			name:    "image urls",
+			input:   `<p>Logo: <img src="/logo.png" alt="ACME"></p>`,
+			options: Options{IncludeImageURLs: true},
+			output:  "Logo: ACME (/logo.png)",
+		},
+		{
+			name:    "data uri dropped",
+			input:   `<p><img src="` + dataURI + `" alt="Pixel"> <a href="` + dataURI + `">download</a></p>`,
+			options: Options{IncludeImageURLs: true},
+			output:  "Pixel download",
+		},
+		{
+			name:    "data uri kept",
+			input:   `<p><img src="` + dataURI + `" alt="Pixel"> <a href="` + dataURI + `">download</a></p>`,
+			options: Options{IncludeImageURLs: true, KeepDataURIImages: true},
+			output:  "Pixel (" + dataURI + ") download\n(" + dataURI + ")",
+		},
+	})
+}
+
+func TestTrailingNewline(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "disabled",
+			input:  "<p>Hello</p>\n\n",
+			output: "Hello",
+		},
+		{
+			name:    "enabled",
+			input:   "<p>Hello</p>\n\n",
+			options: Options{TrailingNewline: true},
+			output:  "Hello\n",
+		},
+		{
+			name:    "empty",
+			input:   "<p></p>",
+			options: Options{TrailingNewline: true},
+			output:  "",
+		},
+	})
+}
+
+func TestLineBreaks(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "leading break in paragraph",
+			input:  "<p><br>text</p>",
+			output: "text",
+		},
+		{
+			name:   "leading break after paragraph",
+			input:  "<p>one</p><p><br>two</p>",
+			output: "one\n\ntwo",
+		},
+		{
+			name:   "consecutive breaks",
+			input:  "text<br><br>more",
+			output: "text\n\nmore",
+		},
+		{
+			name:   "break between paragraphs",
+			input:  "<p>one</p><br><br><p>two</p>",
+			output: "one\n\ntwo",
+		},
+		{
+			name:   "leading break in list item",
+			input:  "<ul><li><br>item</li></ul>",
+			output: "- item",
+		},
+	})
+}
+
+func TestInlineSpacing(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "spaces around bold",
+			input:  "foo <b>bar</b> baz",
+			output: "foo *bar* baz",
+		},
+		{
+			name:   "spaces inside bold",
+			input:  "foo<b> bar </b>baz",
+			output: "foo *bar* baz",
+		},
+		{
+			name:   "no spaces around bold",
+			input:  "un<b>believ</b>able",
+			output: "un*believ*able",
+		},
+		{
+			name:   "spaces around emphasis",
+			input:  "foo <em>bar</em> baz",
+			output: "foo _bar_ baz",
+		},
+		{
+			name:   "punctuation after emphasis",
+			input:  "foo <em>bar</em>, baz",
+			output: "foo _bar_, baz",
+		},
+		{
+			name:   "spaces around code",
+			input:  "run <code>go test</code> now",
+			output: "run go test now",
+		},
+		{
+			name:   "no spaces around code",
+			input:  "(<code>x</code>)",
+			output: "(x)",
+		},
+		{
+			name:   "nested inline elements",
+			input:  "<p>a <span><b>b</b> </span>c</p>",
+			output: "a *b* c",
+		},
+	})
+}
+
+func TestLineEnding(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "default",
+			input:   "<p>one</p><p>two<br>three</p>",
+			options: Options{LineEnding: "\n"},
+			output:  "one\n\ntwo\n\nthree",
+		},
+		{
+			name:    "crlf",
+			input:   "<p>one</p><p>two<br>three</p>",
+			options: Options{LineEnding: "\r\n"},
+			output:  "one\r\n\r\ntwo\r\n\r\nthree",
+		},
+		{
+			name:    "crlf headings",
+			input:   "<h1>Title</h1><h2>Section</h2>text",
+			options: Options{LineEnding: "\r\n"},
+			output:  "*****\r\nTitle\r\n*****\r\n\r\nSection\r\n-------\r\n\r\ntext",
+		},
+		{
+			name:    "crlf trailing newline",
+			input:   "<p>one</p>",
+			options: Options{LineEnding: "\r\n", TrailingNewline: true},
+			output:  "one\r\n",
+		},
+		{
+			name:    "crlf wrapped list item",
+			input:   "<ul><li>" + strings.Repeat("word ", 20) + "</li></ul>",
+			options: Options{LineEnding: "\r\n"},
+			output:  "- word word word word word word word word word word word word word word word\r\n  word word word word word",
+		},
+	})
+}
+
+func TestWarnings(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		options  Options
+		output   string
+		warnings []string
+	}{
+		{
+			name:   "none",
+			input:  "<p>Hello</p>",
+			output: "Hello",
+		},
+		{
+			name:     "skipped script",
+			input:    "<p>Hello</p><script>alert(1)</script>",
+			output:   "Hello",
+			warnings: []string{"skipped <script> element"},
+		},
+		{
+			name:    "malformed table",
+			input:   "<table><tr><td>a</td><td>b</td></tr><tr><td>c</td></tr></table>",
+			options: Options{PlainTableColumnPadding: &PlainTableColumnPadding{}},
+			output:  "a  b\nc",
+			warnings: []string{
+				"html2text: malformed table: table 1 row 2 spans 1 columns, expected 2",
+			},
+		},
+		{
+			name:   "malformed plain table",
+			input:  "<table><thead><tr><td>a</td><td>b</td></tr></thead><tr><td>c</td></tr></table>",
+			output: "abc",
+			warnings: []string{
+				"html2text: malformed table: table 1 row 2 spans 1 columns, expected 2",
+			},
+		},
+		{
+			name:     "disallowed link scheme",
+			input:    `<a href="javascript:alert(1)">click</a>`,
+			options:  Options{LinkSchemeWhitelist: []string{"https"}},
+			output:   "click",
+			warnings: []string{"dropped link with disallowed scheme: javascript:alert(1)"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			text, warnings, err := FromStringWithWarnings(tc.input, tc.options)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if text != tc.output {
+				t.Errorf("unexpected output %q", text)
+			}
+
+			var messages []string
+			for _, w := range warnings {
+				if w.Node == nil {
+					t.Errorf("warning %q has no node", w.Message)
+				}
+				messages = append(messages, w.Message)
+			}
+			if fmt.Sprint(messages) != fmt.Sprint(tc.warnings) {
+				t.Errorf("unexpected warnings %q, expected %q", messages, tc.warnings)
+			}
+		})
+	}
+}
+
+func TestRowHeaders(t *testing.T) {
+	const matrix = `<table>
+		<tr><th>Time</th><th scope="col">Mon</th><th scope="col">Tue</th></tr>
+		<tr><th scope="row">AM</th><td>1</td><td>2</td></tr>
+		<tr><th scope="ROW">PM</th><td>3</td><td>4</td></tr>
+	</table>`
+
+	runTestCases(t, []testCase{
+		{
+			name:    "pretty",
+			input:   matrix,
+			options: Options{PrettyTables: true},
+			output: `+------+-----+-----+
+| TIME | MON | TUE |
++------+-----+-----+
+| AM   |   1 |   2 |
+| PM   |   3 |   4 |
++------+-----+-----+`,
+		},
+		{
+			name:    "plain",
+			input:   matrix,
+			options: Options{PlainTableColumnPadding: &PlainTableColumnPadding{}},
+			output:  "Time  Mon  Tue\nAM    1    2\nPM    3    4",
+		},
+		{
+			name:    "implicit row headers",
+			input:   "<table><tr><th>Name</th><td>Ann</td></tr><tr><th>Age</th><td>30</td></tr></table>",
+			options: Options{PlainTableColumnPadding: &PlainTableColumnPadding{}},
+			output:  "Name  Ann\nAge   30",
+		},
+		{
+			name:    "explicit column header",
+			input:   `<table><tr><th scope="col">Name</th><td>Ann</td></tr></table>`,
+			options: Options{PlainTableColumnPadding: &PlainTableColumnPadding{}},
+			output:  "Name\nAnn",
+		},
+		{
+			name:    "short footer row",
+			input:   "<table><tr><td>a</td><td>b</td></tr><tfoot><tr><th scope=row>x</th></tr></tfoot></table>",
+			options: Options{PrettyTables: true},
+			output:  "+---+---+\n| a | b |\n+---+---+\n| X |    \n+---+---+",
+		},
+		{
+			name:    "short header row",
+			input:   "<table><thead><tr><th>h</th></tr></thead><tr><td>a</td><td>b</td></tr></table>",
+			options: Options{PrettyTables: true},
+			output:  "+---+---+\n| H |   |\n+---+---+\n| a | b |\n+---+---+",
+		},
+	})
+}
+
+func TestCodeFences(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "inline code",
+			input:   "<p>Run <code>go test</code>, then <code>go vet</code>.</p>",
+			options: Options{CodeFences: true},
+			output:  "Run `go test`, then `go vet`.",
+		},
+		{
+			name:    "teletype",
+			input:   "<p>Run <tt>ls -la</tt> first.</p>",
+			options: Options{CodeFences: true},
+			output:  "Run `ls -la` first.",
+		},
+		{
+			name:    "inline code with backticks",
+			input:   "<p>Quote with <code>a`b</code> or <code>``</code>, not <code>`x` ``y``</code>.</p>",
+			options: Options{CodeFences: true},
+			output:  "Quote with ``a`b`` or ``` `` ```, not ``` `x` ``y`` ```.",
+		},
+		{
+			name:    "teletype text only",
+			input:   "<p>Run <tt>ls -la</tt> first.</p>",
+			options: Options{CodeFences: true, TextOnly: true},
+			output:  "Run ls -la first.",
+		},
+		{
+			name:    "pre",
+			input:   "<p>Code:</p><pre>if x {\n    y()\n}</pre><p>Done.</p>",
+			options: Options{CodeFences: true},
+			output:  "Code:\n\n```\nif x {\n    y()\n}\n```\n\nDone.",
+		},
+		{
+			name:    "pre and code",
+			input:   "<p>Code:</p><pre><code>if x {\n    y()\n}\n</code></pre><p>Done.</p>",
+			options: Options{CodeFences: true},
+			output:  "Code:\n\n```\nif x {\n    y()\n}\n```\n\nDone.",
+		},
+		{
+			name:    "code language",
+			input:   "<pre><code class=\"hljs language-go\">fmt.Println()\n</code></pre>",
+			options: Options{CodeFences: true},
+			output:  "```go\nfmt.Println()\n```",
+		},
+		{
+			name:    "pre language",
+			input:   "<pre class=\"lang-sh\">\n  <code>ls</code>\n</pre>",
+			options: Options{CodeFences: true, PreTrimIndent: true},
+			output:  "```sh\nls\n```",
+		},
+		{
+			name:    "pre with fences",
+			input:   "<pre>```go\nx\n```</pre><pre>`````</pre>",
+			options: Options{CodeFences: true},
+			output:  "````\n```go\nx\n```\n````\n\n``````\n`````\n``````",
+		},
+		{
+			name:    "no language",
+			input:   "<pre><code class=\"hljs\">ls</code></pre>",
+			options: Options{CodeFences: true},
+			output:  "```\nls\n```",
+		},
+		{
+			name:    "text only",
+			input:   "<p>Run <code>go test</code>.</p><pre><code>x</code></pre>",
+			options: Options{CodeFences: true, TextOnly: true},
+			output:  "Run go test.\n\nx",
+		},
+		{
+			name:   "disabled",
+			input:  "<p>Run <code>go test</code>.</p><pre><code>x</code></pre>",
+			output: "Run go test.\n\nx",
+		},
+	})
+}
+
+func TestReferenceLinks(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "reference block",
+			input:   `<p>See <a href="http://a.org">the site</a> and <a href="http://b.org">another <b>one</b></a>.</p>`,
+			options: Options{ReferenceLinks: true},
+			output:  "See [the site][1] and [another *one*][2].\n\n[1]: http://a.org\n[2]: http://b.org",
+		},
+		{
+			name:    "repeated href",
+			input:   `<p><a href="http://a.org">one</a>, <a href="http://b.org">two</a>, <a href="http://a.org">three</a></p>`,
+			options: Options{ReferenceLinks: true},
+			output:  "[one][1], [two][2], [three][1]\n\n[1]: http://a.org\n[2]: http://b.org",
+		},
+		{
+			name:    "image link",
+			input:   `<a href="/i"><img alt="pic" src="p.png"></a>`,
+			options: Options{ReferenceLinks: true},
+			output:  "[pic][1]\n\n[1]: /i",
+		},
+		{
+			name:    "destination with spaces",
+			input:   `<a href="/a b">x</a>`,
+			options: Options{ReferenceLinks: true},
+			output:  "[x][1]\n\n[1]: </a b>",
+		},
+		{
+			name:    "pretty table cell",
+			input:   `<p><a href="http://a">A</a></p><table><tr><td><a href="http://b">B</a></td><td><a href="http://a">again</a></td></tr></table>`,
+			options: Options{ReferenceLinks: true, PrettyTables: true},
+			output: "" +
+				"[A][1]\n\n" +
+				"+--------+------------+\n" +
+				"| [B][2] | [again][1] |\n" +
+				"+--------+------------+\n\n" +
+				"[1]: http://a\n" +
+				"[2]: http://b",
+		},
+		{
+			name:    "name-only anchor",
+			input:   `<p><a name="top">Top</a></p>`,
+			options: Options{ReferenceLinks: true},
+			output:  "Top",
+		},
+	})
+}
+
+func TestANSIColors(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "emphasis and links",
+			input:   `<p>Some <b>bold</b> and <em>italic</em> with <a href="http://x.org">a link</a>.</p>`,
+			options: Options{ANSIColors: true},
+			output:  "Some \x1b[1mbold\x1b[22m and \x1b[3mitalic\x1b[23m with a link (\x1b[4mhttp://x.org\x1b[24m).",
+		},
+		{
+			name:    "heading",
+			input:   "<h1>Title</h1>",
+			options: Options{ANSIColors: true},
+			output:  "*****\n\x1b[1mTitle\x1b[22m\n*****",
+		},
+		{
+			name:    "wrapping ignores escapes",
+			input:   "<p><b>aaaaaaaaaa bbbbbbbbbb cccccccccc dddddddddd eeeeeeeeee ffffffffff gggggggggg</b> h i</p>",
+			options: Options{ANSIColors: true},
+			output:  "\x1b[1maaaaaaaaaa bbbbbbbbbb cccccccccc dddddddddd eeeeeeeeee ffffffffff gggggggggg\x1b[22m h\ni",
+		},
+		{
+			name:    "text only",
+			input:   "<h1>Title</h1><p><b>x</b></p>",
+			options: Options{ANSIColors: true, TextOnly: true},
+			output:  "Title\n\nx",
+		},
+	})
+}
+
+func TestKbd(t *testing.T) {
+	const (
+		combo  = "<p>Press <kbd>Ctrl</kbd>+<kbd>C</kbd> to copy.</p>"
+		nested = "<p>Press <kbd><kbd>Ctrl</kbd>+<kbd>Shift</kbd>+<kbd>T</kbd></kbd> now.</p>"
+		spaced = "<p>Press <kbd>Ctrl</kbd> + <kbd>C</kbd>.</p>"
+	)
+
+	runTestCases(t, []testCase{
+		{
+			name:   "combo",
+			input:  combo,
+			output: "Press Ctrl+C to copy.",
+		},
+		{
+			name:   "nested combo",
+			input:  nested,
+			output: "Press Ctrl+Shift+T now.",
+		},
+		{
+			name:   "spaced combo",
+			input:  spaced,
+			output: "Press Ctrl + C.",
+		},
+		{
+			name:    "code combo",
+			input:   combo,
+			options: Options{CodeFences: true},
+			output:  "Press `Ctrl`+`C` to copy.",
+		},
+		{
+			name:    "code nested combo",
+			input:   nested,
+			options: Options{CodeFences: true},
+			output:  "Press `Ctrl`+`Shift`+`T` now.",
+		},
+		{
+			name:    "code spaced combo",
+			input:   spaced,
+			options: Options{CodeFences: true},
+			output:  "Press `Ctrl` + `C`.",
+		},
+		{
+			name:    "code single key",
+			input:   "<p>Hit <kbd>Enter</kbd></p>",
+			options: Options{CodeFences: true},
+			output:  "Hit `Enter`",
+		},
+	})
+}
+
+func TestImagePlaceholder(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "default",
+			input:   `<p><a href="/home"><img src="/logo.png" alt="ACME"></a></p>`,
+			options: Options{},
+			output:  "ACME (/home)",
+		},
+		{
+			name:    "linked image",
+			input:   `<p><a href="/home"><img src="/logo.png" alt="ACME"></a></p>`,
+			options: Options{ImagePlaceholder: "[image: {alt}]"},
+			output:  "[image: ACME] (/home)",
+		},
+		{
+			name:    "standalone image",
+			input:   `<p>Logo: <img src="/logo.png" alt="ACME"></p>`,
+			options: Options{ImagePlaceholder: "[image: {alt}]", IncludeImageURLs: true},
+			output:  "Logo: [image: ACME] (/logo.png)",
+		},
+		{
+			name:    "missing alt",
+			input:   `<p>Logo: <img src="/logo.png"></p>`,
+			options: Options{ImagePlaceholder: "[image: {alt}]", IncludeImageURLs: true},
+			output:  "Logo: (/logo.png)",
+		},
+	})
+}
+
+func TestTemplate(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "skipped",
+			input:  "<p>Before</p><template><p>Hello, <b>{{name}}</b></p></template><p>After</p>",
+			output: "Before\n\nAfter",
+		},
+		{
+			name:   "in table",
+			input:  "<table><tr><td>a</td></tr><template><tr><td>row</td></tr></template></table>",
+			output: "a",
+		},
+	})
+}
+
+func TestSentencePerLine(t *testing.T) {
+	long := strings.Repeat("word ", 30)
+
+	runTestCases(t, []testCase{
+		{
+			name:   "disabled",
+			input:  "<p>First sentence. Second one? Third!</p>",
+			output: "First sentence. Second one? Third!",
+		},
+		{
+			name:    "paragraph",
+			input:   "<p>First sentence. Second one? Third!</p><p>Not wrapped, " + long + "</p>",
+			options: Options{SentencePerLine: true},
+			output:  "First sentence.\nSecond one?\nThird!\n\nNot wrapped, " + strings.TrimSpace(long),
+		},
+		{
+			name:    "markup",
+			input:   `<p>It is <b>done.</b> "Really?" she asked. (Yes.) <a href="/x">Link</a> text.</p>`,
+			options: Options{SentencePerLine: true},
+			output:  "It is *done.*\n\"Really?\" she asked.\n(Yes.)\nLink (/x) text.",
+		},
+		{
+			name:    "abbreviations",
+			input:   "<p>Use a tool, e.g. Go. J. Doe wrote it. Numbers like 3.14 stay. lowercase. Next.</p>",
+			options: Options{SentencePerLine: true},
+			output:  "Use a tool, e.g. Go.\nJ. Doe wrote it.\nNumbers like 3.14 stay. lowercase.\nNext.",
+		},
+		{
+			name:    "list item",
+			input:   "<ul><li>One. Two.</li></ul>",
+			options: Options{SentencePerLine: true},
+			output:  "- One.\n  Two.",
+		},
+	})
+}
+
+func TestShowLang(t *testing.T) {
+	const input = `<html lang="en"><body><p>He said <span lang="fr">bonjour</span> and <span lang="EN">hi</span>.</p>` +
+		`<blockquote lang="de"><p>Guten Tag</p><p lang="de">Wie geht's?</p></blockquote><p lang="ja"></p><p>End</p></body></html>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "disabled",
+			input:  input,
+			output: "He said bonjour and hi.\n\nGuten Tag\n\nWie geht's?\n\nEnd",
+		},
+		{
+			name:    "annotated",
+			input:   input,
+			options: Options{ShowLang: true},
+			output:  "He said [fr] bonjour and hi.\n\n[de] Guten Tag\n\nWie geht's?\n\nEnd",
+		},
+		{
+			name:    "list items",
+			input:   `<ul lang="es"><li>uno</li><li lang="it">due</li></ul>`,
+			options: Options{ShowLang: true},
+			output:  "- [es] uno\n- [it] due",
+		},
+		{
+			name:    "document language",
+			input:   `<body lang="en"><p>Hello</p></body>`,
+			options: Options{ShowLang: true},
+			output:  "Hello",
+		},
+	})
+}
+
+func TestNoscript(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "rendered by default",
+			input:  "<p>a</p><noscript><p>Enable <b>JavaScript</b></p></noscript><p>b</p>",
+			output: "a\n\nEnable *JavaScript*\n\nb",
+		},
+		{
+			name:   "inline",
+			input:  "<p>Loading <noscript>failed, <i>sorry</i></noscript></p>",
+			output: "Loading failed, _sorry_",
+		},
+		{
+			name:    "skipped",
+			input:   "<p>a</p><noscript><p>Enable <b>JavaScript</b></p></noscript><p>b</p>",
+			options: Options{SkipNoscript: true},
+			output:  "a\n\nb",
+		},
+	})
+}
+
+func TestAriaHidden(t *testing.T) {
+	const input = `<p><span class="icon" aria-hidden="true">★</span> Starred <span aria-hidden="false">item</span></p>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "kept by default",
+			input:  input,
+			output: "★ Starred item",
+		},
+		{
+			name:    "skipped",
+			input:   input,
+			options: Options{SkipAriaHidden: true},
+			output:  "Starred item",
+		},
+		{
+			name:    "skipped block",
+			input:   `<div aria-hidden="TRUE"><p>Decoration</p></div><p>Content</p>`,
+			options: Options{SkipAriaHidden: true},
+			output:  "Content",
+		},
+	})
+}
+
+func TestEmitTitle(t *testing.T) {
+	const input = "<html><head><title> My\n Page </title></head><body><h2>Intro</h2><p>Text</p></body></html>"
+
+	runTestCases(t, []testCase{
+		{
+			name:    "title",
+			input:   input,
+			options: Options{EmitTitle: true},
+			output:  "*******\nMy Page\n*******\n\nIntro\n-----\n\nText",
+		},
+		{
+			name:    "not numbered",
+			input:   input,
+			options: Options{EmitTitle: true, HeadingNumbering: true},
+			output:  "*******\nMy Page\n*******\n\n1 Intro\n-------\n\nText",
+		},
+		{
+			name:    "plain text body",
+			input:   "<title>Notes</title>Hello",
+			options: Options{EmitTitle: true, TextOnly: true},
+			output:  "Notes\n\nHello",
+		},
+		{
+			name:    "empty title",
+			input:   "<title> </title><p>Text</p>",
+			options: Options{EmitTitle: true},
+			output:  "Text",
+		},
+		{
+			name:   "disabled",
+			input:  input,
+			output: "Intro\n-----\n\nText",
+		},
+	})
+}
+
+func TestBlockquoteAttribution(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "footer",
+			input:   "<blockquote><p>To be, or not to be.</p><footer>— <cite>Hamlet</cite></footer></blockquote><p>After</p>",
+			options: Options{BlockquoteAttribution: true},
+			output:  "To be, or not to be.\n\n— Hamlet\n\nAfter",
+		},
+		{
+			name:    "cite",
+			input:   "<blockquote>Stay hungry. <cite>Steve Jobs</cite></blockquote>",
+			options: Options{BlockquoteAttribution: true},
+			output:  "Stay hungry.\n— Steve Jobs",
+		},
+		{
+			name:    "own dash replaced",
+			input:   "<blockquote><p>Quote</p><footer>-- <b>Me</b></footer></blockquote>",
+			options: Options{BlockquoteAttribution: true},
+			output:  "Quote\n\n— *Me*",
+		},
+		{
+			name:    "cite within text",
+			input:   "<blockquote>As <cite>Hamlet</cite> says, to be or not.</blockquote>",
+			options: Options{BlockquoteAttribution: true},
+			output:  "As Hamlet says, to be or not.",
+		},
+		{
+			name:   "disabled",
+			input:  "<blockquote>Stay hungry. <cite>Steve Jobs</cite></blockquote>",
+			output: "Stay hungry. Steve Jobs",
+		},
+	})
+}
+
+func TestHeadingNumbering(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "levels",
+			input:   "<h1>A</h1><h2>B</h2><h3>C</h3><h2>D</h2><h1>E</h1>",
+			options: Options{HeadingNumbering: true, OmitH1TopDivider: true},
+			output:  "1 A\n***\n\n1.1 B\n-----\n\n1.1.1 C\n-------\n\n1.2 D\n-----\n\n2 E\n***",
+		},
+		{
+			name:    "starting below h1",
+			input:   "<h2>A</h2><h3>B</h3><h2>C</h2>",
+			options: Options{HeadingNumbering: true, TextOnly: true},
+			output:  "1 A\n\n1.1 B\n\n2 C",
+		},
+		{
+			name:    "skipped level",
+			input:   "<h1>A</h1><h3>B</h3>",
+			options: Options{HeadingNumbering: true, TextOnly: true},
+			output:  "1 A\n\n1.0.1 B",
+		},
+		{
+			name:    "higher level later",
+			input:   "<h2>A</h2><h1>B</h1><h2>C</h2>",
+			options: Options{HeadingNumbering: true, TextOnly: true},
+			output:  "1 A\n\n2 B\n\n2.1 C",
+		},
+		{
+			name:    "legend",
+			input:   "<fieldset><legend>Intro</legend>x</fieldset><h1>A</h1><fieldset><legend>Info</legend>y</fieldset><h1>B</h1>",
+			options: Options{HeadingNumbering: true, TextOnly: true},
+			output:  "Intro\n\nx\n\n1 A\n\nInfo\n\ny\n\n2 B",
+		},
+		{
+			name:    "with anchors",
+			input:   "<h2>Usage</h2>",
+			options: Options{HeadingNumbering: true, HeadingAnchors: true},
+			output:  "1 Usage {#usage}\n----------------",
+		},
+		{
+			name:    "table cell",
+			input:   "<h1>First</h1><table><tr><td><h1>Cell</h1></td></tr></table><h2>Sub</h2>",
+			options: Options{HeadingNumbering: true, PrettyTables: true, TextOnly: true},
+			output:  "1 First\n\n+--------+\n| 2 Cell |\n+--------+\n\n2.1 Sub",
+		},
+	})
+}
+
+func TestHeadingAnchors(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "slugs",
+			input:   "<h2>Getting Started!</h2><h3>Install <code>x_y</code></h3>",
+			options: Options{HeadingAnchors: true},
+			output:  "Getting Started! {#getting-started}\n-----------------------------------\n\nInstall x_y {#install-x-y}\n--------------------------",
+		},
+		{
+			name:    "duplicate slugs",
+			input:   "<h2>Usage</h2><h2>usage</h2><h2>Usage</h2>",
+			options: Options{HeadingAnchors: true, HeadingBottomSpacing: 1},
+			output:  "Usage {#usage}\n--------------\nusage {#usage-1}\n----------------\nUsage {#usage-2}\n----------------",
+		},
+		{
+			name:    "id",
+			input:   `<h2 id="install">Installing the tool</h2>`,
+			options: Options{HeadingAnchors: true},
+			output:  "Installing the tool {#install}\n------------------------------",
+		},
+		{
+			name:    "id colliding with slug",
+			input:   `<h2>Install</h2><h2 id="install">Installing</h2><h2 id="install">Again</h2>`,
+			options: Options{HeadingAnchors: true},
+			output:  "Install {#install-1}\n--------------------\n\nInstalling {#install}\n---------------------\n\nAgain {#install}\n----------------",
+		},
+		{
+			name:    "table cell",
+			input:   `<h2>A</h2><table><tr><td><h2>A</h2></td></tr></table>`,
+			options: Options{HeadingAnchors: true, PrettyTables: true},
+			output:  "A {#a}\n------\n\n+----------+\n| A {#a-1} |\n| -------- |\n+----------+",
+		},
+		{
+			name:    "format",
+			input:   "<h1>Title</h1>",
+			options: Options{HeadingAnchors: true, HeadingAnchorFormat: "[#{slug}]", OmitH1TopDivider: true},
+			output:  "Title [#title]\n**************",
+		},
+		{
+			name:    "text only",
+			input:   "<h2>Title</h2>",
+			options: Options{HeadingAnchors: true, TextOnly: true},
+			output:  "Title",
+		},
+	})
+}
+
+func TestUppercaseHeadings(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "divider matches uppercased text",
+			input:   "<h1>Über café</h1><h2>Section <b>two</b></h2>",
+			options: Options{UppercaseHeadings: true},
+			output:  "*********\nÜBER CAFÉ\n*********\n\nSECTION *TWO*\n-------------",
+		},
+		{
+			name:    "link hrefs unchanged",
+			input:   `<h2>See <a href="https://example.com/Docs">docs</a></h2>`,
+			options: Options{UppercaseHeadings: true},
+			output:  "SEE DOCS (https://example.com/Docs)\n-----------------------------------",
+		},
+		{
+			name:    "uncased text",
+			input:   "<h2>日本語</h2>",
+			options: Options{UppercaseHeadings: true},
+			output:  "日本語\n------",
+		},
+		{
+			name:    "body text unchanged",
+			input:   "<h3>Title</h3><p>Body</p>",
+			options: Options{UppercaseHeadings: true},
+			output:  "TITLE\n-----\n\nBody",
+		},
+	})
+}
+
+func TestTablesAsKeyValue(t *testing.T) {
+	const specs = `<table>
+		<tr><th>Weight</th><td>1.2 kg</td></tr>
+		<tr><td>Color</td><td><b>Red</b></td></tr>
+		<tr><td>Notes</td><td><p>Hand</p><p>wash</p></td></tr>
+	</table>`
+	const grid = `<table><tr><td>a</td><td>b</td><td>c</td></tr><tr><td>d</td><td>e</td><td>f</td></tr></table>`
+
+	runTestCases(t, []testCase{
+		{
+			name:    "two columns",
+			input:   specs,
+			options: Options{TablesAsKeyValue: true},
+			output:  "Weight: 1.2 kg\nColor: *Red*\nNotes: Hand wash",
+		},
+		{
+			name:    "two columns with pretty tables",
+			input:   specs,
+			options: Options{TablesAsKeyValue: true, PrettyTables: true},
+			output:  "Weight: 1.2 kg\nColor: *Red*\nNotes: Hand wash",
+		},
+		{
+			name:    "other columns",
+			input:   grid,
+			options: Options{TablesAsKeyValue: true},
+			output:  "a  b  c\nd  e  f",
+		},
+		{
+			name:    "other columns with pretty tables",
+			input:   grid,
+			options: Options{TablesAsKeyValue: true, PrettyTables: true},
+			output:  "+---+---+---+\n| a | b | c |\n| d | e | f |\n+---+---+---+",
+		},
+	})
+}
+
+func TestSmall(t *testing.T) {
+	const input = "<p>Price: $5 <small>fine print</small></p>"
+
+	runTestCases(t, []testCase{
+		{
+			name:   "default",
+			input:  input,
+			output: "Price: $5 fine print",
+		},
+		{
+			name:    "parenthesized",
+			input:   input,
+			options: Options{ParenthesizeSmall: true},
+			output:  "Price: $5 (fine print)",
+		},
+		{
+			name:    "custom delimiters",
+			input:   input,
+			options: Options{ParenthesizeSmall: true, SmallDelimiters: [2]string{"[small: ", "]"}},
+			output:  "Price: $5 [small: fine print]",
+		},
+		{
+			name:    "delimiters without ParenthesizeSmall",
+			input:   input,
+			options: Options{SmallDelimiters: [2]string{"<", ">"}},
+			output:  "Price: $5 fine print",
+		},
+		{
+			name:    "text only",
+			input:   input,
+			options: Options{ParenthesizeSmall: true, TextOnly: true},
+			output:  "Price: $5 fine print",
+		},
+	})
+}
+
+func TestFromTokenizer(t *testing.T) {
+	// Documents without content needing lookahead render as with FromString.
+	for _, test := range []struct {
+		input   string
+		options Options
+	}{
+		{input: "<html><head><title>T</title><style>p {}</style></head><body><h1>Title</h1><p>Some <b>bold</b> and <em>italic</em> with <a href=\"http://x.org\">a link</a>.</p></body></html>"},
+		{input: "<ul><li>one<li>two</ul><ol start=3><li>a</li><li><p>b</p><p>c</p></li></ol>"},
+		{input: "<pre>\ncode\n  indented</pre><p>a<br>b<p>next<div>div</div><script>bad()</script>"},
+		{input: "<p>a</p><template><p>Hidden <b>markup</b></p></template><p>b</p>"},
+		{input: "<p>a</p><noscript><p>Enable <b>JS</b></p></noscript><p>b</p>"},
+		{input: "<p>a</p><noscript><p>Enable <b>JS</b></p></noscript><p>b</p>", options: Options{SkipNoscript: true}},
+		{input: "<html lang=en><p>Say <i lang=fr>oui</i></p><ul lang=de><li>eins<li lang=it>due</ul><p lang=ja></p>end", options: Options{ShowLang: true}},
+		{input: "<p>" + strings.Repeat("word ", 40) + "</p><h2>Sub heading</h2>tail"},
+		{input: "<h2 id=x>A</h2><h3>B</h3>", options: Options{HeadingNumbering: true, HeadingAnchors: true}},
+		{input: "<p><a href=\"/a\">one</a> <a href=\"/b\">two</a></p>", options: Options{ReferenceLinks: true}},
+		{input: "<p><a href=\"/a\">one</a> <a href=\"/b\">two</a></p>", options: Options{LinkPlacement: LinkBeforeText}},
+		{input: "<p><a href=\"/a\">one</a> <a href=\"/b\">two</a></p>", options: Options{LinkPlacement: LinkOnSeparateLine}},
+		{input: "<p><b>bold <b>nested</b></b> <i>x</i></p>", options: Options{TextOnly: true}},
+		{input: "<b>  spaced  </b>x <b> </b>y<i></i>z <b><i> both </i> b </b> c"},
+		{input: "<p>a <b><a href=\"/a\">one</a> </b>b</p>", options: Options{ReferenceLinks: true}},
+		{input: "<p>x</p><p><b>a</b> <i>b</i></p>", options: Options{ANSIColors: true}},
+		{input: "<ul><li><p>one</p><li><p>two</p> <li><p>three</p>more<li>four<p>five</p></ul>"},
+		{input: "<p style=\"font-weight: bold\">bold</p><span style=\"font-style: italic\"> it </span>x <b style=\"font-style: italic\">both</b>"},
+		{input: "<div style=\"white-space: pre\">a   b\n  c</div>d   e"},
+	} {
+		expected, err := FromString(test.input, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, err := FromTokenizer(html.NewTokenizer(strings.NewReader(test.input)), test.options)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.input, err)
+		} else if text != expected {
+			t.Errorf("unexpected output for %q\ngot:      %q\nexpected: %q", test.input, text, expected)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		options Options
+		output  string
+		err     error
+	}{
+		{
+			name:   "table cells",
+			input:  "<table><tr><td>a<td>b<tr><td>c</table>",
+			output: "a b\nc",
+		},
+		{
+			name:   "unclosed elements",
+			input:  "<p><b>bold <i>both",
+			output: "*bold _both_*",
+		},
+		{
+			name:   "task list",
+			input:  "<ul><li><input type=checkbox checked> done<li><input type=checkbox> todo</ul>",
+			output: "- done\n- todo",
+		},
+		{
+			name:   "emphasis around blocks",
+			input:  "<div style=\"font-weight: bold\"><p>a</p><p>b</p></div>",
+			output: "*a\n\nb\n\n*",
+		},
+		{
+			name:   "line break within emphasis",
+			input:  "<p><b>a<br>b</b></p>",
+			output: "*a\n\nb*",
+		},
+		{
+			name:    "inline elements",
+			input:   "<p><code>x</code> <small>s</small></p>",
+			options: Options{CodeFences: true, ParenthesizeSmall: true},
+			output:  "x s",
+		},
+		{
+			name:    "content options",
+			input:   "<head><title>T</title></head><p>a</p><p></p><p aria-hidden=true>hidden</p><p><a href=\"/u\">long text</a></p>",
+			options: Options{EmitTitle: true, NumberParagraphs: true, PreserveEmptyParagraphs: true, SkipAriaHidden: true, MaxLinkTextLength: 4},
+			output:  "a\n\nhidden\n\nlong text (/u)",
+		},
+		{
+			name:    "max depth",
+			input:   strings.Repeat("<div>", 20) + "deep",
+			options: Options{MaxDepth: 10},
+			err:     ErrMaxDepth,
+		},
+		{
+			name:    "invalid options",
+			input:   "x",
+			options: Options{Indent: -1},
+			err:     ErrInvalidOptions,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := FromTokenizer(html.NewTokenizer(strings.NewReader(test.input)), test.options)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("unexpected error %v, expected %v", err, test.err)
+			}
+			if text != test.output {
+				t.Errorf("unexpected output %q, expected %q", text, test.output)
+			}
+		})
+	}
+
+	z := html.NewTokenizer(strings.NewReader("<p>" + strings.Repeat("x", 100) + "</p>"))
+	z.SetMaxBuf(10)
+	if _, err := FromTokenizer(z); !errors.Is(err, html.ErrBufferExceeded) {
+		t.Errorf("expected ErrBufferExceeded, got %v", err)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	tests := []struct {
+		input   string
+		options Options
+	}{
+		{input: "Hello, world!"},
+		{input: "<p>Hello, <b>world</b>!</p>"},
+		{input: "<p>" + strings.Repeat("Lorem ipsum dolor sit amet, 日本語のテキスト. ", 20) + "</p>"},
+		{input: "<p>a &amp; b &lt;c&gt;</p>", options: Options{HTMLEntitiesInOutput: true}},
+	}
+
+	for _, test := range tests {
+		text, err := FromString(test.input, test.options)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		again, err := FromString(text, test.options)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if again != text {
+			t.Errorf("%q: converting output again changed it\nfirst:  %q\nsecond: %q", test.input, text, again)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		options Options
+		err     string
+	}{
+		{options: Options{}},
+		{options: Options{MaxDepth: 10, MaxLength: 100, PrettyTables: true}},
+		{options: Options{MaxDepth: -1}, err: "html2text: invalid options: MaxDepth is negative"},
+		{options: Options{MaxLinkTextLength: -1}, err: "html2text: invalid options: MaxLinkTextLength is negative"},
+		{options: Options{HeadingBottomSpacing: -2}, err: "html2text: invalid options: HeadingBottomSpacing is negative"},
+		{options: Options{Indent: 77}},
+		{options: Options{Indent: 78}, err: "html2text: invalid options: Indent leaves no room for text within 78 columns"},
+		{
+			options: Options{PlainTableColumnPadding: &PlainTableColumnPadding{MinWidth: -1}},
+			err:     "html2text: invalid options: PlainTableColumnPadding.MinWidth is negative",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.options.Validate()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error: %v", test.options, err)
+			}
+			continue
+		}
+
+		if !errors.Is(err, ErrInvalidOptions) || err.Error() != test.err {
+			t.Errorf("%+v: expected error %q, got %v", test.options, test.err, err)
+		}
+		if _, err := FromString("<p>text</p>", test.options); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%+v: expected FromString to return ErrInvalidOptions, got %v", test.options, err)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "options",
+			input:  `<p>Size: <select><option>Small</option><option label="Medium (M)">M</option></select></p>`,
+			output: "Size:\n\nSmall\nMedium (M)",
+		},
+		{
+			name: "optgroups",
+			input: `<select>
+				<optgroup label="Fruits"><option>Apple</option><option>Banana</option></optgroup>
+				<optgroup label="Empty"></optgroup>
+				<optgroup><option>Unlabelled</option></optgroup>
+				<option>Other</option>
+			</select>`,
+			output: "Fruits\n  Apple\n  Banana\nEmpty\nUnlabelled\nOther",
+		},
+		{
+			name:   "empty",
+			input:  "<p>a<select></select>b</p>",
+			output: "ab",
+		},
+	})
+
+	// The parser never nests optgroups, but trees built by hand may.
+	doc, err := html.Parse(strings.NewReader(`<select><optgroup label="Outer"><option>a</option></optgroup></select>`))
+	if err != nil {
+		t.Fatal("failed to parse:", err)
+	}
+	outer := doc.FirstChild.LastChild.FirstChild.FirstChild
+	inner := &html.Node{Type: html.ElementNode, Data: "optgroup", DataAtom: atom.Optgroup, Attr: []html.Attribute{{Key: "label", Val: "Inner"}}}
+	inner.AppendChild(&html.Node{Type: html.ElementNode, Data: "optgroup", DataAtom: atom.Optgroup})
+	option := &html.Node{Type: html.ElementNode, Data: "option", DataAtom: atom.Option}
+	option.AppendChild(&html.Node{Type: html.TextNode, Data: "b"})
+	inner.AppendChild(option)
+	outer.AppendChild(inner)
+
+	text, err := FromHTMLNode(doc)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if expected := "Outer\n  a\n  Inner\n    b"; text != expected {
+		t.Errorf("unexpected output %q, expected %q", text, expected)
+	}
+}
+
+func TestTablesAsCSV(t *testing.T) {
+	const input = `<table>
+		<thead><tr><th>Name</th><th>Note</th></tr></thead>
+		<tbody>
+			<tr><td>Doe, Jane</td><td>said "hi"</td></tr>
+			<tr><td>Roe</td><td><p>two</p><p>lines</p></td></tr>
+		</tbody>
+	</table>`
+
+	runTestCases(t, []testCase{
+		{
+			name:    "csv",
+			input:   input,
+			options: Options{TablesAsCSV: true},
+			output:  "Name,Note\n\"Doe, Jane\",\"said \"\"hi\"\"\"\nRoe,\"two\nlines\"",
+		},
+		{
+			name:    "tsv",
+			input:   input,
+			options: Options{TablesAsCSV: true, CSVSeparator: '\t'},
+			output:  "Name\tNote\nDoe, Jane\t\"said \"\"hi\"\"\"\nRoe\t\"two\nlines\"",
+		},
+		{
+			name:    "surrounding text",
+			input:   "<p>Before</p><table><tr><td>a</td><td>b</td></tr></table><p>After</p>",
+			options: Options{TablesAsCSV: true},
+			output:  "Before\n\na,b\n\nAfter",
+		},
+	})
+
+	for _, options := range []Options{
+		{TablesAsCSV: true, PrettyTables: true},
+		{TablesAsCSV: true, TablesAsKeyValue: true},
+		{TablesAsCSV: true, CSVSeparator: '"'},
+	} {
+		if err := options.Validate(); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%+v: expected ErrInvalidOptions, got %v", options, err)
+		}
+	}
+}
+
+func TestNumberParagraphs(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "numbered",
+			input:   "<p>One</p><p></p><div><p>Two <b>bold</b></p></div><ul><li>Item</li></ul><p>Three</p>",
+			options: Options{NumberParagraphs: true},
+			output:  "[¶1] One\n\n[¶2] Two *bold*\n\n- Item\n\n[¶3] Three",
+		},
+		{
+			name:   "disabled",
+			input:  "<p>One</p><p>Two</p>",
+			output: "One\n\nTwo",
+		},
+		{
+			name:    "block link",
+			input:   `<p>x</p><a href="http://x"><p>a</p></a><p>y</p>`,
+			options: Options{NumberParagraphs: true},
+			output:  "[¶1] x\n\n[¶2] a (http://x)\n\n[¶3] y",
+		},
+	})
+}
+
+func TestPreserveEmptyParagraphs(t *testing.T) {
+	const input = "<p>a</p><p></p><p> </p><p><br></p><p>b</p>"
+
+	runTestCases(t, []testCase{
+		{
+			name:   "collapsed by default",
+			input:  input,
+			output: "a\n\nb",
+		},
+		{
+			name:    "preserved",
+			input:   input,
+			options: Options{PreserveEmptyParagraphs: true},
+			output:  "a\n\n\n\n\nb",
+		},
+		{
+			name:    "single",
+			input:   "<p>a</p><p></p><p>b</p>",
+			options: Options{PreserveEmptyParagraphs: true},
+			output:  "a\n\n\nb",
+		},
+		{
+			name:    "document edges",
+			input:   "<p></p><p>a</p><p></p>",
+			options: Options{PreserveEmptyParagraphs: true},
+			output:  "a",
+		},
+	})
+}
+
+func TestStyleEmphasis(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "bold span",
+			input:  `<p>a <span style="font-weight: bold">b</span> c</p>`,
+			output: "a *b* c",
+		},
+		{
+			name:   "numeric weights",
+			input:  `<p><span style="font-weight:700">heavy</span> <span style="font-weight: 400">normal</span></p>`,
+			output: "*heavy* normal",
+		},
+		{
+			name:   "italic span",
+			input:  `<p>a <span style="FONT-STYLE: italic">b</span> c</p>`,
+			output: "a _b_ c",
+		},
+		{
+			name:   "bold and italic",
+			input:  `<span style="font-weight:bolder; font-style:oblique 10deg">x</span>`,
+			output: "*_x_*",
+		},
+		{
+			name:   "bold element with bold style",
+			input:  `<b style="font-weight:bold">x</b>`,
+			output: "*x*",
+		},
+		{
+			name:   "styled paragraph",
+			input:  `<p style="font-style:italic">one <span style="font-style:italic">two</span></p><p>three</p>`,
+			output: "_one two_\n\nthree",
+		},
+		{
+			name:    "text only",
+			input:   `<span style="font-weight:bold">x</span>`,
+			options: Options{TextOnly: true},
+			output:  "x",
+		},
+		{
+			name:   "paragraphs",
+			input:  `<div style="font-weight:bold"><p>a</p><p>b</p></div>`,
+			output: "*a*\n\n*b*",
+		},
+		{
+			name:    "pretty table",
+			input:   `<div style="font-weight:bold"><table><tr><td>a</td><td>b</td></tr></table></div>`,
+			options: Options{PrettyTables: true},
+			output:  "+---+---+\n| a | b |\n+---+---+",
+		},
+		{
+			name:   "list",
+			input:  `<ul style="font-style:italic"><li>a</li><li>b</li></ul>`,
+			output: "- _a_\n- _b_",
+		},
+		{
+			name:   "heading and text",
+			input:  `<div style="font-weight:bold"><h2>T</h2>text</div>`,
+			output: "T\n-\n\n*text*",
+		},
+		{
+			name:   "inline runs between blocks",
+			input:  `<div style="font-style:italic">x <b>y</b><p>z</p></div>`,
+			output: "_x *y*_\n\n_z_",
+		},
+		{
+			name:   "pre",
+			input:  `<div style="font-weight:bold"><pre>code</pre></div>`,
+			output: "code",
+		},
+	})
+}
+
+func TestFormControls(t *testing.T) {
+	const input = `<p>Go: <input type="image" alt="Submit order"> or <button>Click <b>me</b></button>.</p>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "default",
+			input:  input,
+			output: "Go: or Click *me*.",
+		},
+		{
+			name:    "rendered",
+			input:   input,
+			options: Options{RenderFormControls: true},
+			output:  "Go: [Submit order] or [Click *me*].",
+		},
+		{
+			name:    "button inputs",
+			input:   `<form><input type="submit" value="Send"> <input type="reset"></form>`,
+			options: Options{RenderFormControls: true},
+			output:  "[Send]",
+		},
+		{
+			name:    "labelled fields",
+			input:   `<form><label>Name: <input name="n"></label><br><label>Email<input type="email" value="a@b.c"></label><br><label>Password <input type="password" value="secret"></label><input type="hidden" value="x"></form>`,
+			options: Options{RenderFormControls: true},
+			output:  "Name: [____]\n\nEmail [a@b.c]\n\nPassword [____]",
+		},
+		{
+			name:    "checkboxes and radios",
+			input:   `<p><label><input type="checkbox" checked> Remember</label> <label><input type="checkbox">Subscribe</label></p><p><label><input type="radio" name="r" checked> A</label> <label><input type="radio" name="r"> B</label></p>`,
+			options: Options{RenderFormControls: true},
+			output:  "[x] Remember [ ] Subscribe\n\n(*) A ( ) B",
+		},
+		{
+			name:    "task list",
+			input:   `<ul><li><input type="checkbox" checked> Done</li></ul>`,
+			options: Options{RenderFormControls: true},
+			output:  "- [x] Done",
+		},
+		{
+			name:    "labelled fields text only",
+			input:   `<label>Name: <input name="n"></label> <label><input type="checkbox"> Remember</label>`,
+			options: Options{RenderFormControls: true, TextOnly: true},
+			output:  "Name: Remember",
+		},
+		{
+			name:    "text only",
+			input:   input,
+			options: Options{RenderFormControls: true, TextOnly: true},
+			output:  "Go: Submit order or Click me.",
+		},
+	})
+}
+
+func TestMergeAdjacentEmphasis(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "not merged by default",
+			input:  "<b>foo</b><b>bar</b>",
+			output: "*foo**bar*",
+		},
+		{
+			name:    "adjacent bold",
+			input:   "<b>foo</b><strong>bar</strong>",
+			options: Options{MergeAdjacentEmphasis: true},
+			output:  "*foobar*",
+		},
+		{
+			name:    "adjacent italic",
+			input:   "<p>a <i>foo</i> <em>bar</em> b</p>",
+			options: Options{MergeAdjacentEmphasis: true},
+			output:  "a _foo bar_ b",
+		},
+		{
+			name:    "different kinds",
+			input:   "<b>foo</b><i>bar</i>",
+			options: Options{MergeAdjacentEmphasis: true},
+			output:  "*foo*_bar_",
+		},
+		{
+			name:    "separated by text",
+			input:   "<b>a</b>, <b>b</b>",
+			options: Options{MergeAdjacentEmphasis: true},
+			output:  "*a*, *b*",
+		},
+		{
+			name:    "nested",
+			input:   "<b><b>x</b><b>y</b></b><b>z</b>",
+			options: Options{MergeAdjacentEmphasis: true},
+			output:  "*xyz*",
+		},
+		{
+			name:    "skipped first",
+			input:   "<p>a <b aria-hidden=\"true\">x</b> <b>y</b> b</p>",
+			options: Options{MergeAdjacentEmphasis: true, SkipAriaHidden: true},
+			output:  "a *y* b",
+		},
+		{
+			name:    "skipped between",
+			input:   "<p><b>x</b> <b aria-hidden=\"true\">h</b> <b>y</b></p>",
+			options: Options{MergeAdjacentEmphasis: true, SkipAriaHidden: true},
+			output:  "*x* *y*",
+		},
+	})
+}
+
+func TestPreTrimIndent(t *testing.T) {
+	const input = "<p>Code:</p><pre>\n    if x {\n        y()\n    }\n  </pre>"
+
+	runTestCases(t, []testCase{
+		{
+			name:   "verbatim by default",
+			input:  input,
+			output: "Code:\n\n    if x {\n        y()\n    }",
+		},
+		{
+			name:    "dedented",
+			input:   input,
+			options: Options{PreTrimIndent: true},
+			output:  "Code:\n\nif x {\n    y()\n}",
+		},
+		{
+			name:    "code fences",
+			input:   "<pre><code>\tif x {\n\n\t\ty()\n\t}\n</code></pre>",
+			options: Options{PreTrimIndent: true, CodeFences: true},
+			output:  "```\nif x {\n\n\ty()\n}\n```",
+		},
+		{
+			name:    "mixed indentation",
+			input:   "<p>Code:</p><pre>\t  a\n\t b</pre>",
+			options: Options{PreTrimIndent: true},
+			output:  "Code:\n\n a\nb",
+		},
+		{
+			name:    "unindented line",
+			input:   "<pre>  a\nb</pre>",
+			options: Options{PreTrimIndent: true},
+			output:  "a\nb",
+		},
+		{
+			name:    "highlighted markup",
+			input:   "<pre>  <span class=\"k\">if</span> x {\n    <span class=\"f\">y</span>()\n  }</pre>",
+			options: Options{PreTrimIndent: true},
+			output:  "if x {\n  y()\n}",
+		},
+	})
+}
+
+func TestTimeFormatter(t *testing.T) {
+	format := func(datetime string) string {
+		parsed, err := time.Parse("2006-01-02", datetime)
+		if err != nil {
+			return datetime
+		}
+		return parsed.Format("Jan 2, 2006")
+	}
+	const input = `<p>Posted <time datetime="2024-03-05">yesterday</time>, edited <time>2024-03-06</time>.</p>`
+
+	runTestCases(t, []testCase{
+		{
+			name:   "disabled",
+			input:  input,
+			output: "Posted yesterday, edited 2024-03-06.",
+		},
+		{
+			name:    "replaced",
+			input:   input,
+			options: Options{TimeFormatter: format},
+			output:  "Posted Mar 5, 2024, edited Mar 6, 2024.",
+		},
+		{
+			name:    "appended",
+			input:   input,
+			options: Options{TimeFormatter: format, AppendFormattedTime: true},
+			output:  "Posted yesterday (Mar 5, 2024), edited 2024-03-06 (Mar 6, 2024).",
+		},
+		{
+			name:    "invalid",
+			input:   `<p>Due <time datetime="soon"><b>next week</b></time></p>`,
+			options: Options{TimeFormatter: format},
+			output:  "Due *next week*",
+		},
+	})
+}
+
+func TestDataValues(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "value",
+			input:   `<p>SKU <data value="398">Mini Ketchup</data>, <data value="x">x</data></p>`,
+			options: Options{DataValues: true},
+			output:  "SKU Mini Ketchup (398), x",
+		},
+		{
+			name:    "output",
+			input:   `<p>Sum: <output name="sum" for="a b">60</output></p>`,
+			options: Options{DataValues: true},
+			output:  "Sum: 60",
+		},
+		{
+			name:   "disabled",
+			input:  `<p>SKU <data value="398">Mini Ketchup</data></p>`,
+			output: "SKU Mini Ketchup",
+		},
+	})
+}
+
+func TestDfn(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "emphasized",
+			input:  "<p>A <dfn>widget</dfn> is a gadget.</p>",
+			output: "A _widget_ is a gadget.",
+		},
+		{
+			name:   "title",
+			input:  `<p><dfn title="HyperText Markup Language">HTML</dfn>, the markup language.</p>`,
+			output: "_HTML_ (HyperText Markup Language), the markup language.",
+		},
+		{
+			name:   "title matching content",
+			input:  `<p>A <dfn title="widget">widget</dfn> is a gadget.</p>`,
+			output: "A _widget_ is a gadget.",
+		},
+		{
+			name:    "text only",
+			input:   `<p><dfn title="HyperText Markup Language">HTML</dfn> is markup.</p>`,
+			options: Options{TextOnly: true},
+			output:  "HTML (HyperText Markup Language) is markup.",
+		},
+	})
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "nfc",
+			input:   "<p>Cafe\u0301 cre\u0300me</p>",
+			options: Options{NormalizeUnicode: "NFC"},
+			output:  "Caf\u00e9 cr\u00e8me",
+		},
+		{
+			name:    "nfc keeps compatibility characters",
+			input:   "<p>\ufb01ne \u2460</p>",
+			options: Options{NormalizeUnicode: "NFC"},
+			output:  "\ufb01ne \u2460",
+		},
+		{
+			name:    "nfkc",
+			input:   "<p>\ufb01ne \u2460 Cafe\u0301</p>",
+			options: Options{NormalizeUnicode: "NFKC"},
+			output:  "fine 1 Caf\u00e9",
+		},
+		{
+			name:   "disabled",
+			input:  "<p>Cafe\u0301</p>",
+			output: "Cafe\u0301",
+		},
+	})
+
+	if _, err := FromString("<p>a</p>", Options{NormalizeUnicode: "NFD"}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected ErrInvalidOptions for an unsupported form, got %v", err)
+	}
+}
+
+func TestCharset(t *testing.T) {
+	// "Café" in ISO-8859-1 and "日本語" in Shift_JIS.
+	latin1 := "<html><head><meta charset=\"iso-8859-1\"></head><body><p>Caf\xe9</p></body></html>"
+	shiftJIS := "<p>\x93\xfa\x96\x7b\x8c\xea</p>"
+
+	tests := []struct {
+		name    string
+		input   string
+		options Options
+		output  string
+	}{
+		{
+			name:    "declared latin-1",
+			input:   latin1,
+			options: Options{DetectCharset: true},
+			output:  "Café",
+		},
+		{
+			name:    "declared shift_jis",
+			input:   `<meta http-equiv="Content-Type" content="text/html; charset=Shift_JIS">` + shiftJIS,
+			options: Options{DetectCharset: true},
+			output:  "日本語",
+		},
+		{
+			name:    "given shift_jis",
+			input:   shiftJIS,
+			options: Options{Charset: "shift_jis"},
+			output:  "日本語",
+		},
+		{
+			name:    "given charset overrides declared",
+			input:   "<meta charset=\"utf-8\"><p>Caf\xe9</p>",
+			options: Options{Charset: "latin1", DetectCharset: true},
+			output:  "Café",
+		},
+		{
+			name:    "undeclared utf-8",
+			input:   "<!-- " + strings.Repeat("a", 2000) + " --><p>日本語</p>",
+			options: Options{DetectCharset: true},
+			output:  "日本語",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := FromReader(strings.NewReader(test.input), test.options)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if text != test.output {
+				t.Errorf("unexpected output %q, expected %q", text, test.output)
+			}
+		})
+	}
+
+	if _, err := FromString("<p>a</p>", Options{Charset: "no-such-charset"}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected ErrInvalidOptions for an unknown charset, got %v", err)
+	}
+}
+
+func TestWideCharacters(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "japanese sentence",
+			input:  "<p>吾輩は猫である。名前はまだ無い。どこで生れたかとんと見当がつかぬ。何でも薄暗いじめじめした所でニャーニャー泣いていた事だけは記憶している。</p>",
+			output: "吾輩は猫である。名前はまだ無い。どこで生れたかとんと見当がつかぬ。何でも薄暗い\nじめじめした所でニャーニャー泣いていた事だけは記憶している。",
+		},
+		{
+			name:   "after latin text",
+			input:  "<p>Note: <b>吾輩は猫である。名前はまだ無い。どこで生れたかとんと見当がつかぬ。何でも薄暗いじめじめした所。</b></p>",
+			output: "Note: *吾輩は猫である。名前はまだ無い。どこで生れたかとんと見当がつかぬ。何で\nも薄暗いじめじめした所。*",
+		},
+		{
+			name:   "closing punctuation",
+			input:  "<p>" + strings.Repeat("あ", 39) + "。いい</p>",
+			output: strings.Repeat("あ", 38) + "\nあ。いい",
+		},
+		{
+			name:   "source line breaks",
+			input:  "<p>日本\n語 and\nEnglish</p>",
+			output: "日本語 and English",
+		},
+	})
+}
+
+func TestIndent(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:    "wrapping paragraph",
+			input:   "<p>" + strings.Repeat("word ", 18) + "</p><p>next</p>",
+			options: Options{Indent: 4},
+			output: "    word word word word word word word word word word word word word word word\n" +
+				"    word word word\n" +
+				"\n" +
+				"    next",
+		},
+		{
+			name:    "list",
+			input:   "<ul><li>" + strings.Repeat("item ", 16) + "</li></ul>",
+			options: Options{Indent: 2},
+			output: "  - item item item item item item item item item item item item item item item\n" +
+				"    item",
+		},
+	})
+}
+
+func TestRuby(t *testing.T) {
+	runTestCases(t, []testCase{
+		{
+			name:   "parenthesized",
+			input:  "<p><ruby>漢<rt>かん</rt>字<rt>じ</rt></ruby>です</p>",
+			output: "漢(かん)字(じ)です",
+		},
+		{
+			name:   "rp fallback",
+			input:  "<p><ruby>漢字<rp>（</rp><rt>かんじ</rt><rp>）</rp></ruby></p>",
+			output: "漢字（かんじ）",
+		},
+		{
+			name:    "inline",
+			input:   "<p><ruby>漢字<rp>（</rp><rt>かんじ</rt><rp>）</rp></ruby></p>",
+			options: Options{InlineRuby: true},
+			output:  "漢字かんじ",
+		},
+	})
+}